@@ -0,0 +1,62 @@
+package main
+
+// interpolation modes of keys, the mode of a key applies to the segment following it
+const (
+	LinearInterpolation = iota
+	BezierInterpolation
+)
+
+// Animation is a range of frames rendered one after another
+type Animation struct {
+	start, end int
+	fps        float64
+}
+
+// keyWeights returns indices of up to four keys and their weights for interpolation at given time,
+// key returns time and interpolation mode of the i-th of n keys sorted by time
+func keyWeights(n int, key func(i int) (float64, int), time float64) ([4]int, [4]float64) {
+	first, _ := key(0)
+	if n == 1 || time <= first {
+		return [4]int{0}, [4]float64{1}
+	}
+	last, _ := key(n - 1)
+	if time >= last {
+		return [4]int{n - 1}, [4]float64{1}
+	}
+
+	b := 1
+	for ; b < n-1; b++ {
+		if tb, _ := key(b); time < tb {
+			break
+		}
+	}
+	a := b - 1
+	ta, mode := key(a)
+	tb, _ := key(b)
+	dt := tb - ta
+	f := (time - ta) / dt
+	if mode == LinearInterpolation {
+		return [4]int{a, b}, [4]float64{1 - f, f}
+	}
+
+	// cubic Hermite spline with Catmull-Rom tangents, which is a Bezier curve with automatic handles
+	prev, next := a, b
+	ca, cb := 1.0, 1.0
+	if a > 0 {
+		prev = a - 1
+		tp, _ := key(prev)
+		ca = dt / (tb - tp)
+	}
+	if b < n-1 {
+		next = b + 1
+		tn, _ := key(next)
+		cb = dt / (tn - ta)
+	}
+	f2 := f * f
+	f3 := f2 * f
+	h00 := 2*f3 - 3*f2 + 1
+	h10 := f3 - 2*f2 + f
+	h01 := -2*f3 + 3*f2
+	h11 := f3 - f2
+	return [4]int{prev, a, b, next}, [4]float64{-h10 * ca, h00 - h11*cb, h01 + h10*ca, h11 * cb}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+)
+
+// arbitrary output variables rendered along with the beauty image
+const (
+	AlbedoAOV = iota
+	NormalAOV
+	PositionAOV
+	DepthAOV
+	UVAOV
+	ObjectAOV
+	MaterialAOV
+	DiffuseDirectAOV
+	DiffuseIndirectAOV
+	SpecularDirectAOV
+	SpecularIndirectAOV
+	EmissionAOV
+	aovCount
+)
+
+// aovNames are names of AOVs used on the command line, in file names and as names of EXR layers
+var aovNames = [aovCount]string{"albedo", "normal", "position", "depth", "uv", "object", "material", "diffuse_direct", "diffuse_indirect", "specular_direct", "specular_indirect", "emission"}
+
+// AOVSample collects values of a sample at the first hit and the kind of its path,
+// light of the beauty image is split by the first bounce into diffuse and specular and by the length of the path into direct and indirect
+type AOVSample struct {
+	albedo, normal, position Color
+	depth, u, v              float64
+	object, material         int
+	specular                 bool  // the first bounce was specular
+	direct                   bool  // the path ended on a light right after the first bounce
+	emission                 Color // light emitted by the first hit
+}
+
+// record stores values of the first hit of the camera ray
+func (s *AOVSample) record(r Ray, rec HitRecord) {
+	m := rec.material.at(r.time)
+	s.albedo = m.albedo.color(rec)
+	n := rec.normal.Normalize()
+	s.normal = Color{n.x, n.y, n.z}
+	s.position = Color{rec.p.x, rec.p.y, rec.p.z}
+	s.depth = rec.t * r.direction.Magnitude()
+	s.u, s.v = rec.u, rec.v
+	s.object, s.material = m.object, m.id
+}
+
+// values returns value of every AOV for the sample with color col of the beauty image
+func (s *AOVSample) values(col Color) [aovCount]Color {
+	var v [aovCount]Color
+	v[AlbedoAOV] = s.albedo
+	v[NormalAOV] = s.normal
+	v[PositionAOV] = s.position
+	v[DepthAOV] = Color{s.depth, s.depth, s.depth}
+	v[UVAOV] = Color{s.u, s.v, 0}
+	v[ObjectAOV] = idColor(s.object)
+	v[MaterialAOV] = idColor(s.material)
+	v[EmissionAOV] = s.emission
+	light := col.Subtract(s.emission)
+	if s.specular && s.direct {
+		v[SpecularDirectAOV] = light
+	} else if s.specular {
+		v[SpecularIndirectAOV] = light
+	} else if s.direct {
+		v[DiffuseDirectAOV] = light
+	} else {
+		v[DiffuseIndirectAOV] = light
+	}
+	return v
+}
+
+// idColor returns a distinct color for every ID, so that masks of objects can be keyed out, zero is black background
+func idColor(id int) Color {
+	if id == 0 {
+		return Color{0, 0, 0}
+	}
+	h := hash(uint64(id))
+	return Color{hashFloat(h), hashFloat(h + 1), hashFloat(h + 2)}
+}
+
+// aovLayer returns EXR layer of an AOV with channels named by their meaning
+func aovLayer(kind int, canvas []Color) Layer {
+	l := colorLayer(aovNames[kind], canvas)
+	if kind == NormalAOV || kind == PositionAOV {
+		l.channels = []string{"X", "Y", "Z"}
+	} else if kind == DepthAOV {
+		l.channels, l.values = []string{"Z"}, l.values[:1]
+	} else if kind == UVAOV {
+		l.channels, l.values = []string{"U", "V"}, l.values[:2]
+	}
+	return l
+}
+
+// aovDisplay maps values of data AOVs into range [0, 1] for display formats, normals from [-1, 1] and depth by the farthest pixel
+func aovDisplay(kind int, canvas []Color) []Color {
+	if kind != NormalAOV && kind != DepthAOV {
+		return canvas
+	}
+	far := 0.0
+	for _, c := range canvas {
+		far = math.Max(far, c.r)
+	}
+	display := make([]Color, len(canvas))
+	for i, c := range canvas {
+		if kind == NormalAOV {
+			display[i] = Color{0.5*c.r + 0.5, 0.5*c.g + 0.5, 0.5*c.b + 0.5}
+		} else if far > 0 {
+			display[i] = c.DivScalar(far)
+		}
+	}
+	return display
+}
+
+// SaveAOVs writes the beauty image with AOVs, as layers of a single EXR image or as images with the name of the AOV as suffix,
+// light AOVs are tone mapped like the beauty image while data AOVs are written as they are
+func SaveAOVs(canvas []Color, aovs [][]Color, kinds []int, width, height int, fileName string, extension, depth int, config ColorConfig, tone ToneMap) {
+	if extension == EXR {
+		layers := []Layer{colorLayer("", canvas)}
+		for i, kind := range kinds {
+			layers = append(layers, aovLayer(kind, aovs[i]))
+		}
+		pixelType := HalfPixel
+		if depth == 32 {
+			pixelType = FloatPixel
+		}
+		check(SaveEXR(layers, width, height, fileName, pixelType, exrCompression, config))
+		return
+	}
+	SaveImage(canvas, width, height, 255, fileName, extension, depth, config, tone)
+	for i, kind := range kinds {
+		name := fileName + "_" + aovNames[kind]
+		if kind >= DiffuseDirectAOV {
+			SaveImage(aovs[i], width, height, 255, name, extension, depth, config, tone)
+		} else if kind == AlbedoAOV {
+			SaveImage(aovs[i], width, height, 255, name, extension, depth, config, ToneMap{})
+		} else {
+			values := aovs[i]
+			if extension != HDR && extension != PFM {
+				values = aovDisplay(kind, values)
+			}
+			// data is not a picture, so it is written without color conversions
+			SaveImage(values, width, height, 255, name, extension, depth, dataConfig, ToneMap{})
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// shapes of the lens aperture
+const (
+	CircularBokeh = iota
+	PolygonBokeh
+	ImageBokeh
+)
+
+// Bokeh describes the shape of the aperture which shows up in out of focus highlights
+type Bokeh struct {
+	shape         int
+	blades        int
+	rotation      float64
+	cdf           []float64 // cumulative brightness of image pixels, row by row
+	width, height int
+	radius        float64 // of the circle around the center of the image which bounds its bright pixels
+}
+
+func getPolygonBokeh(blades int, rotation float64) Bokeh {
+	return Bokeh{PolygonBokeh, blades, rotation, nil, 0, 0, 0}
+}
+
+// getImageBokeh returns aperture shaped like the brightness of the image
+func getImageBokeh(texture [][]Color) Bokeh {
+	width := len(texture)
+	height := len(texture[0])
+	cdf := make([]float64, width*height)
+	sum, radius := 0.0, 0.0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := texture[x][y]
+			brightness := math.Max(0, (c.r+c.g+c.b)/3)
+			if brightness > 0 {
+				// the farthest corner of the pixel from the center
+				dx := math.Max(math.Abs(float64(x)-float64(width)/2), math.Abs(float64(x+1)-float64(width)/2))
+				dy := math.Max(math.Abs(float64(y)-float64(height)/2), math.Abs(float64(y+1)-float64(height)/2))
+				radius = math.Max(radius, math.Hypot(dx, dy))
+			}
+			sum += brightness
+			cdf[y*width+x] = sum
+		}
+	}
+	if sum == 0 {
+		return Bokeh{}
+	}
+	return Bokeh{ImageBokeh, 0, 0, cdf, width, height, radius}
+}
+
+// sample returns random point on the aperture inside the unit disk
+func (b Bokeh) sample(generator *Sampler) Tuple {
+	if b.shape == PolygonBokeh && b.blades >= 3 {
+		// pick one of the triangles between the center and the edges
+		step := 2 * math.Pi / float64(b.blades)
+		angle := b.rotation + step*math.Floor(RandFloat(generator)*float64(b.blades))
+		v0 := Tuple{math.Cos(angle), math.Sin(angle), 0, 0}
+		v1 := Tuple{math.Cos(angle + step), math.Sin(angle + step), 0, 0}
+		r1, r2 := RandFloat(generator), RandFloat(generator)
+		if r1+r2 > 1 {
+			r1, r2 = 1-r1, 1-r2
+		}
+		return v0.MulScalar(r1).Add(v1.MulScalar(r2))
+	} else if b.shape == ImageBokeh {
+		target := RandFloat(generator) * b.cdf[len(b.cdf)-1]
+		i := sort.SearchFloat64s(b.cdf, target)
+		if i >= len(b.cdf) {
+			i = len(b.cdf) - 1
+		}
+		x := float64(i%b.width) + RandFloat(generator)
+		y := float64(i/b.width) + RandFloat(generator)
+		// circle bounding the bright pixels is the edge of the lens
+		return Tuple{(x - float64(b.width)/2) / b.radius, (float64(b.height)/2 - y) / b.radius, 0, 0}
+	}
+	return randomDisk(generator)
+}
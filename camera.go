@@ -2,44 +2,270 @@ package main
 
 import (
 	"math"
-	"math/rand"
 )
 
-type Camera struct {
+// Camera generates rays for image coordinates s and t in range [0, 1] at given time,
+// starting at the bottom left corner, false means there is nothing to see at that point
+type Camera interface {
+	getRay(s, t, time float64, generator *Sampler) (Ray, bool)
+}
+
+// PerspectiveCamera is a thin lens camera
+type PerspectiveCamera struct {
 	origin, lowerLeftCorner, horizontal, vertical, u, v, w Tuple
 	lensRadius                                             float64
+	spread                                                 float64
+	halfWidth, halfHeight                                  float64
+	bokeh                                                  Bokeh
 }
 
-func randomDisk(generator rand.Rand) Tuple {
-	var p Tuple
-	for {
-		p = Tuple{RandFloat(generator), RandFloat(generator), 0, 0}.MulScalar(2.0).Subtract(Tuple{1, 1, 0, 0})
-		if p.Dot(p) <= 1.0 {
-			break
-		}
+// OrthographicCamera casts parallel rays from a rectangle of given height
+type OrthographicCamera struct {
+	origin, u, v, w Tuple
+	width, height   float64
+}
+
+// FisheyeCamera uses equidistant projection fitted into the height of the image
+type FisheyeCamera struct {
+	origin, u, v, w Tuple
+	fov, aspect     float64
+}
+
+// EquirectangularCamera renders 360 degree panoramas, stereo panoramas
+// have the left eye in the top half and the right eye in the bottom half
+type EquirectangularCamera struct {
+	origin, u, v, w Tuple
+	stereo          bool
+	ipd             float64 // distance between the eyes
+}
+
+// CameraKey holds animated parameters of a camera at a point in time,
+// zero focus means focusing at the point the camera looks at
+type CameraKey struct {
+	time                                       float64
+	from, at, up                               Tuple
+	fov, focalLength, aperture, fNumber, focus float64
+	interpolation                              int
+}
+
+// MotionCamera builds a camera from interpolated keys for the time of every ray
+type MotionCamera struct {
+	keys  []CameraKey
+	build func(k CameraKey) Camera
+}
+
+// shutterSteps is the number of intervals of the open shutter with a camera built for motion blur
+const shutterSteps = 256
+
+// ShutterCamera holds cameras built at evenly spaced times while the shutter is open, rays take the camera nearest to their time
+type ShutterCamera struct {
+	open, close float64
+	cameras     []Camera
+}
+
+// randomDisk maps two dimensions of the sampler onto unit disk with the concentric mapping, which keeps their stratification
+func randomDisk(generator *Sampler) Tuple {
+	a := 2*RandFloat(generator) - 1
+	b := 2*RandFloat(generator) - 1
+	if a == 0 && b == 0 {
+		return Tuple{0, 0, 0, 0}
+	}
+	var r, phi float64
+	if math.Abs(a) > math.Abs(b) {
+		r, phi = a, math.Pi/4*(b/a)
+	} else {
+		r, phi = b, math.Pi/2-math.Pi/4*(a/b)
 	}
-	return p
+	return Tuple{r * math.Cos(phi), r * math.Sin(phi), 0, 0}
+}
+
+// cameraBasis returns right, up and backward vectors of a camera
+func cameraBasis(lookFrom, lookAt, up Tuple) (Tuple, Tuple, Tuple) {
+	w := (lookFrom.Subtract(lookAt)).Normalize()
+	u := up.Cross(w).Normalize()
+	v := w.Cross(u)
+	return u, v, w
 }
 
-func getCamera(lookFrom, lookAt, up Tuple, fov, aspect, aperture, focusDistance float64) Camera {
-	var c Camera
+func getCamera(lookFrom, lookAt, up Tuple, fov, aspect, aperture, focusDistance float64) PerspectiveCamera {
+	var c PerspectiveCamera
 	c.lensRadius = aperture / 2
 	theta := fov * math.Pi / 180
 	halfHeight := math.Tan(theta / 2)
 	halfWidth := aspect * halfHeight
 	c.origin = lookFrom
-	c.w = (lookFrom.Subtract(lookAt)).Normalize()
-	c.u = up.Cross(c.w).Normalize()
-	c.v = c.w.Cross(c.u)
-	c.lowerLeftCorner = c.origin.Add(c.u.MulScalar(-(halfWidth) * focusDistance)).Add(c.v.MulScalar(-(halfHeight) * focusDistance)).Add(c.w.Negate().MulScalar(focusDistance))
-	c.horizontal = c.u.MulScalar(2 * halfWidth * focusDistance)
-	c.vertical = c.v.MulScalar(2 * halfHeight * focusDistance)
+	c.u, c.v, c.w = cameraBasis(lookFrom, lookAt, up)
+	c.halfWidth = halfWidth
+	c.halfHeight = halfHeight
+	c.setFocus(focusDistance)
+	// angle covered by a single pixel, used for texture filtering
+	c.spread = 2 * halfHeight / float64(vsize)
 
 	return c
 }
 
-func (c Camera) getRay(s, t float64, generator rand.Rand) Ray {
-	randomDisk := randomDisk(generator).MulScalar(c.lensRadius)
-	offset := c.u.MulScalar(randomDisk.x).Add(c.v.MulScalar(randomDisk.y))
-	return Ray{c.origin.Add(offset), c.lowerLeftCorner.Add(c.horizontal.MulScalar(s)).Add(c.vertical.MulScalar(t)).Subtract(c.origin).Subtract(offset)}
+// getPhysicalCamera returns camera described by focal length and sensor width in millimeters,
+// the f-number sets the aperture assuming scene units are meters
+func getPhysicalCamera(lookFrom, lookAt, up Tuple, focalLength, sensorWidth, fNumber, aspect, focusDistance float64, bokeh Bokeh) PerspectiveCamera {
+	sensorHeight := sensorWidth / aspect
+	fov := 2 * math.Atan(sensorHeight/(2*focalLength)) * 180 / math.Pi
+	aperture := 0.0
+	if fNumber > 0 {
+		aperture = focalLength / fNumber / 1000
+	}
+	c := getCamera(lookFrom, lookAt, up, fov, aspect, aperture, focusDistance)
+	c.bokeh = bokeh
+	return c
+}
+
+// setFocus moves the plane of focus to given distance from the camera
+func (c *PerspectiveCamera) setFocus(focusDistance float64) {
+	c.lowerLeftCorner = c.origin.Add(c.u.MulScalar(-(c.halfWidth) * focusDistance)).Add(c.v.MulScalar(-(c.halfHeight) * focusDistance)).Add(c.w.Negate().MulScalar(focusDistance))
+	c.horizontal = c.u.MulScalar(2 * c.halfWidth * focusDistance)
+	c.vertical = c.v.MulScalar(2 * c.halfHeight * focusDistance)
+}
+
+// focusDistance returns distance to the surface seen through the pixel at x, y counted from the top left corner at given time
+func (c PerspectiveCamera) focusDistance(world *HittableList, x, y int, time float64) (float64, bool) {
+	s := (float64(x) + 0.5) / float64(hsize)
+	t := 1 - (float64(y)+0.5)/float64(vsize)
+	direction := c.lowerLeftCorner.Add(c.horizontal.MulScalar(s)).Add(c.vertical.MulScalar(t)).Subtract(c.origin)
+	rec := HitRecord{}
+	if !world.hit(Ray{c.origin, direction, 0, 0, time}, Epsilon, math.MaxFloat64, &rec) {
+		return 0, false
+	}
+	// distance is measured along the axis of the camera since the plane of focus is flat
+	return direction.MulScalar(rec.t).Dot(c.w.Negate()), true
+}
+
+// autofocus focuses a perspective camera on the surface seen through the pixel at x, y, keys of animated cameras are focused
+// one by one at their time, false means there was nothing to focus on or the camera has no focus
+func autofocus(camera Camera, world *HittableList, x, y int) (Camera, bool) {
+	if c, ok := camera.(PerspectiveCamera); ok {
+		distance, hit := c.focusDistance(world, x, y, 0)
+		if hit {
+			c.setFocus(distance)
+		}
+		return c, hit
+	} else if m, ok := camera.(MotionCamera); ok {
+		keys := append([]CameraKey(nil), m.keys...)
+		focused := false
+		for i, k := range keys {
+			c, ok := m.build(k).(PerspectiveCamera)
+			if !ok {
+				return camera, false
+			}
+			if distance, hit := c.focusDistance(world, x, y, k.time); hit {
+				keys[i].focus = distance
+				focused = true
+			}
+		}
+		return MotionCamera{keys, m.build}, focused
+	}
+	return camera, false
+}
+
+func getOrthographicCamera(lookFrom, lookAt, up Tuple, height, aspect float64) OrthographicCamera {
+	u, v, w := cameraBasis(lookFrom, lookAt, up)
+	return OrthographicCamera{lookFrom, u, v, w, height * aspect, height}
+}
+
+func getFisheyeCamera(lookFrom, lookAt, up Tuple, fov, aspect float64) FisheyeCamera {
+	u, v, w := cameraBasis(lookFrom, lookAt, up)
+	return FisheyeCamera{lookFrom, u, v, w, fov * math.Pi / 180, aspect}
+}
+
+func getEquirectangularCamera(lookFrom, lookAt, up Tuple, stereo bool, ipd float64) EquirectangularCamera {
+	u, v, w := cameraBasis(lookFrom, lookAt, up)
+	return EquirectangularCamera{lookFrom, u, v, w, stereo, ipd}
+}
+
+func (c PerspectiveCamera) getRay(s, t, time float64, generator *Sampler) (Ray, bool) {
+	lens := c.bokeh.sample(generator).MulScalar(c.lensRadius)
+	offset := c.u.MulScalar(lens.x).Add(c.v.MulScalar(lens.y))
+	return Ray{c.origin.Add(offset), c.lowerLeftCorner.Add(c.horizontal.MulScalar(s)).Add(c.vertical.MulScalar(t)).Subtract(c.origin).Subtract(offset), 0, c.spread, time}, true
+}
+
+func (c OrthographicCamera) getRay(s, t, time float64, generator *Sampler) (Ray, bool) {
+	origin := c.origin.Add(c.u.MulScalar((s - 0.5) * c.width)).Add(c.v.MulScalar((t - 0.5) * c.height))
+	// rays are parallel, so the footprint is constant
+	return Ray{origin, c.w.Negate(), c.height / float64(vsize), 0, time}, true
+}
+
+func (c FisheyeCamera) getRay(s, t, time float64, generator *Sampler) (Ray, bool) {
+	x := (2*s - 1) * c.aspect
+	y := 2*t - 1
+	radius := math.Sqrt(x*x + y*y)
+	if radius > 1 {
+		return Ray{}, false
+	}
+	theta := radius * c.fov / 2
+	phi := math.Atan2(y, x)
+	direction := c.u.MulScalar(math.Sin(theta) * math.Cos(phi)).Add(c.v.MulScalar(math.Sin(theta) * math.Sin(phi))).Subtract(c.w.MulScalar(math.Cos(theta)))
+	return Ray{c.origin, direction, 0, c.fov / float64(vsize), time}, true
+}
+
+func (c EquirectangularCamera) getRay(s, t, time float64, generator *Sampler) (Ray, bool) {
+	origin := c.origin
+	phi := (s - 0.5) * 2 * math.Pi
+	if c.stereo {
+		eye := -0.5
+		if t < 0.5 {
+			eye = 0.5
+			t *= 2
+		} else {
+			t = 2*t - 1
+		}
+		// each eye is offset sideways from the center, perpendicular to the viewing direction
+		right := c.u.MulScalar(math.Cos(phi)).Add(c.w.MulScalar(math.Sin(phi)))
+		origin = origin.Add(right.MulScalar(eye * c.ipd))
+	}
+	theta := (t - 0.5) * math.Pi
+	direction := c.u.MulScalar(math.Cos(theta) * math.Sin(phi)).Add(c.v.MulScalar(math.Sin(theta))).Subtract(c.w.MulScalar(math.Cos(theta) * math.Cos(phi)))
+	return Ray{origin, direction, 0, 2 * math.Pi / float64(hsize), time}, true
+}
+
+// cameraAt interpolates keys, holding the first and the last key outside of their range
+func cameraAt(keys []CameraKey, time float64) CameraKey {
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	indices, weights := keyWeights(len(keys), func(i int) (float64, int) {
+		return keys[i].time, keys[i].interpolation
+	}, time)
+	k := CameraKey{}
+	k.time = time
+	for j, i := range indices {
+		w := weights[j]
+		k.from = k.from.Add(keys[i].from.MulScalar(w))
+		k.at = k.at.Add(keys[i].at.MulScalar(w))
+		k.up = k.up.Add(keys[i].up.MulScalar(w))
+		k.fov += keys[i].fov * w
+		k.focalLength += keys[i].focalLength * w
+		k.aperture += keys[i].aperture * w
+		k.fNumber += keys[i].fNumber * w
+		k.focus += keys[i].focus * w
+	}
+	return k
+}
+
+func (c MotionCamera) getRay(s, t, time float64, generator *Sampler) (Ray, bool) {
+	return c.build(cameraAt(c.keys, time)).getRay(s, t, time, generator)
+}
+
+// frame returns camera for rays between opening and closing of the shutter, so that keys are not interpolated for every ray
+func (c MotionCamera) frame(open, close float64) Camera {
+	if close <= open {
+		return c.build(cameraAt(c.keys, open))
+	}
+	cameras := make([]Camera, shutterSteps+1)
+	for i := range cameras {
+		cameras[i] = c.build(cameraAt(c.keys, open+(close-open)*float64(i)/shutterSteps))
+	}
+	return ShutterCamera{open, close, cameras}
+}
+
+func (c ShutterCamera) getRay(s, t, time float64, generator *Sampler) (Ray, bool) {
+	i := int(math.Round(math.Max(0, math.Min(1, (time-c.open)/(c.close-c.open))) * shutterSteps))
+	return c.cameras[i].getRay(s, t, time, generator)
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"os"
+)
+
+// Checkpoint is the saved state of a frame, fields are exported for gob
+type Checkpoint struct {
+	Scene          string // path of the scene file, empty for the default scene
+	Hash           string // hash of the files of the scene and the size of the image
+	Output         string // name of the image file without extension
+	Frame          int
+	Samples        int // target number of samples of every pixel
+	Sampler        int
+	Filter         int
+	FilterRadius   float64
+	FilterSampling bool
+	Width, Height  int
+	TileSize       int
+	Seed           uint64
+	Pixels         []float64 // sums of samples weighted by the filter, three values for every pixel
+	Weights        []float64 // sums of weights of the filter
+	Sums           []float64 // sums of luminance of own samples of every pixel
+	Squares        []float64
+	Counts         []int
+	AOVs           map[string][]float64 // sums of own samples of AOVs by name, three values for every pixel
+}
+
+// sceneHash identifies the scene a checkpoint was rendered from by the contents of all files it was read from
+func sceneHash(files []string) (string, error) {
+	h := sha256.New()
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		// lengths keep the boundaries of files apart
+		fmt.Fprintf(h, "%d:", len(data))
+		h.Write(data)
+	}
+	fmt.Fprintf(h, "%dx%d", hsize, vsize)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// saveCheckpoint writes the film into a checkpoint, the previous checkpoint is replaced only once the new one is complete
+func saveCheckpoint(path string, c Checkpoint, film *Film) error {
+	pixels, weights, sums, squares, counts := film.snapshot()
+	c.Width, c.Height, c.TileSize = film.width, film.height, film.tileSize
+	c.Seed = film.seed
+	c.Pixels = make([]float64, 0, 3*len(pixels))
+	for _, p := range pixels {
+		c.Pixels = append(c.Pixels, p.r, p.g, p.b)
+	}
+	c.Weights, c.Sums, c.Squares, c.Counts = weights, sums, squares, counts
+	c.AOVs = map[string][]float64{}
+	for k, canvas := range film.snapshotAOVs(true) {
+		values := make([]float64, 0, 3*len(canvas))
+		for _, p := range canvas {
+			values = append(values, p.r, p.g, p.b)
+		}
+		c.AOVs[aovNames[film.kinds[k]]] = values
+	}
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func loadCheckpoint(path string) (Checkpoint, error) {
+	var c Checkpoint
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&c); err != nil {
+		return c, err
+	}
+	n := c.Width * c.Height
+	if len(c.Pixels) != 3*n || len(c.Weights) != n || len(c.Sums) != n || len(c.Squares) != n || len(c.Counts) != n {
+		return c, fmt.Errorf("checkpoint %s is damaged", path)
+	}
+	for _, values := range c.AOVs {
+		if len(values) != 3*n {
+			return c, fmt.Errorf("checkpoint %s is damaged", path)
+		}
+	}
+	return c, nil
+}
+
+// film restores the film of the checkpoint, new samples continue the sequences of the saved ones,
+// AOVs have to be in the checkpoint, otherwise their saved samples would be missing
+func (c Checkpoint) film(order, margin int, kinds []int) (*Film, error) {
+	for _, kind := range kinds {
+		if _, ok := c.AOVs[aovNames[kind]]; !ok {
+			return nil, fmt.Errorf("checkpoint has no %s AOV", aovNames[kind])
+		}
+	}
+	film := getFilm(c.Width, c.Height, c.TileSize, order, margin, kinds)
+	pixels := make([]Color, c.Width*c.Height)
+	for i := range pixels {
+		pixels[i] = Color{c.Pixels[3*i], c.Pixels[3*i+1], c.Pixels[3*i+2]}
+	}
+	film.restore(pixels, c.Weights)
+	copy(film.sums, c.Sums)
+	copy(film.squares, c.Squares)
+	copy(film.counts, c.Counts)
+	for k, kind := range kinds {
+		values := c.AOVs[aovNames[kind]]
+		for i := range film.aovs[k] {
+			film.aovs[k][i] = Color{values[3*i], values[3*i+1], values[3*i+2]}
+		}
+	}
+	film.seed = c.Seed
+	return film, nil
+}
@@ -1,5 +1,7 @@
 package main
 
+import "math"
+
 // Color struct holds three color values
 type Color struct {
 	r, g, b float64
@@ -29,3 +31,38 @@ func (c Color) DivScalar(s float64) Color {
 func (c Color) Mul(c1 Color) Color {
 	return Color{c.r * c1.r, c.g * c1.g, c.b * c1.b}
 }
+
+// lobe is a piecewise gaussian used to approximate CIE matching functions
+func lobe(x, mu, sigma1, sigma2 float64) float64 {
+	sigma := sigma1
+	if x >= mu {
+		sigma = sigma2
+	}
+	t := (x - mu) / sigma
+	return math.Exp(-0.5 * t * t)
+}
+
+// Blackbody returns linear color of a blackbody radiator at temperature in Kelvin normalized to luminance 1
+func Blackbody(temperature float64) Color {
+	var x, y, z float64
+	for lambda := 380.0; lambda <= 780.0; lambda += 5 {
+		// Planck's law without constant factors, since the result is normalized anyway
+		l := lambda * 1e-9
+		radiance := 1 / (math.Pow(l, 5) * (math.Exp(1.4387769e-2/(l*temperature)) - 1))
+
+		x += radiance * (1.056*lobe(lambda, 599.8, 37.9, 31.0) + 0.362*lobe(lambda, 442.0, 16.0, 26.7) - 0.065*lobe(lambda, 501.1, 20.4, 26.2))
+		y += radiance * (0.821*lobe(lambda, 568.8, 46.9, 40.5) + 0.286*lobe(lambda, 530.9, 16.3, 31.1))
+		z += radiance * (1.217*lobe(lambda, 437.0, 11.8, 36.0) + 0.681*lobe(lambda, 459.0, 26.0, 13.8))
+	}
+	if y <= 0 {
+		return Color{0, 0, 0}
+	}
+	x, z = x/y, z/y
+	y = 1
+
+	return Color{
+		math.Max(0, 3.2404542*x-1.5371385*y-0.4985314*z),
+		math.Max(0, -0.9692660*x+1.8760108*y+0.0415560*z),
+		math.Max(0, 0.0556434*x-0.2040259*y+1.0572252*z),
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+)
+
+// working color spaces
+const (
+	LinearSRGB = iota
+	ACEScg
+)
+
+// display encodings of saved images
+const (
+	SRGB = iota
+	Rec709
+	LinearDisplay
+)
+
+// ColorConfig describes the color space used for rendering and the encoding of output images
+type ColorConfig struct {
+	working int
+	display int
+}
+
+// defaultConfig renders in linear sRGB for sRGB displays, scene files may choose others
+var defaultConfig = ColorConfig{LinearSRGB, SRGB}
+
+// dataConfig writes data like normals and depth without color conversions
+var dataConfig = ColorConfig{LinearSRGB, LinearDisplay}
+
+// SRGBToLinear decodes sRGB encoded value
+func SRGBToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// LinearToSRGB encodes linear value with sRGB transfer function
+func LinearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// LinearToRec709 encodes linear value with Rec.709 transfer function
+func LinearToRec709(v float64) float64 {
+	if v < 0.018 {
+		return v * 4.5
+	}
+	return 1.099*math.Pow(v, 0.45) - 0.099
+}
+
+// mulMatrix multiplies color by a 3x3 matrix
+func mulMatrix(m [3][3]float64, c Color) Color {
+	return Color{
+		m[0][0]*c.r + m[0][1]*c.g + m[0][2]*c.b,
+		m[1][0]*c.r + m[1][1]*c.g + m[1][2]*c.b,
+		m[2][0]*c.r + m[2][1]*c.g + m[2][2]*c.b,
+	}
+}
+
+// linear sRGB to ACEScg with Bradford adaptation from D65 to D60
+var srgbToACEScg = [3][3]float64{
+	{0.6131324224, 0.3395380158, 0.0474166960},
+	{0.0701243808, 0.9163940113, 0.0134515240},
+	{0.0205876575, 0.1095745716, 0.8697854040},
+}
+
+var acescgToSRGB = [3][3]float64{
+	{1.7048586763, -0.6217160219, -0.0832993717},
+	{-0.1300768242, 1.1407357748, -0.0105598017},
+	{-0.0239640729, -0.1289755083, 1.1530140189},
+}
+
+// fromLinearSRGB converts linear sRGB color into the working space
+func (config ColorConfig) fromLinearSRGB(c Color) Color {
+	if config.working == ACEScg {
+		return mulMatrix(srgbToACEScg, c)
+	}
+	return c
+}
+
+// toLinearSRGB converts color in the working space into linear sRGB
+func (config ColorConfig) toLinearSRGB(c Color) Color {
+	if config.working == ACEScg {
+		return mulMatrix(acescgToSRGB, c)
+	}
+	return c
+}
+
+// encode converts color in the working space into display encoded values in range [0, 1] after tone mapping it
+func (config ColorConfig) encode(c Color, tone ToneMap) Color {
+	c = tone.apply(config.toLinearSRGB(c))
+	c = Color{math.Max(0, math.Min(1, c.r)), math.Max(0, math.Min(1, c.g)), math.Max(0, math.Min(1, c.b))}
+	if config.display == SRGB {
+		return Color{LinearToSRGB(c.r), LinearToSRGB(c.g), LinearToSRGB(c.b)}
+	} else if config.display == Rec709 {
+		return Color{LinearToRec709(c.r), LinearToRec709(c.g), LinearToRec709(c.b)}
+	}
+	return c
+}
+
+// luminance returns relative luminance of color in the working space
+func (config ColorConfig) luminance(c Color) float64 {
+	if config.working == ACEScg {
+		return 0.2722287*c.r + 0.6740818*c.g + 0.0536895*c.b
+	}
+	return 0.2126729*c.r + 0.7151522*c.g + 0.0721750*c.b
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Denoiser is a non-local means filter guided by albedo, normal and depth AOVs, guides which are nil are not used
+type Denoiser struct {
+	radius   int     // of the window of compared pixels
+	patch    int     // radius of patches compared by color
+	strength float64 // larger values blur more
+	normal   float64 // deviation of normals
+	depth    float64 // deviation of depth relative to the depth of the pixel
+	albedo   float64 // deviation of albedo
+}
+
+func getDenoiser(radius int, strength float64) Denoiser {
+	return Denoiser{radius, 1, strength, 0.25, 0.1, 0.1}
+}
+
+// demodulate divides colors by albedo, so that textures are not blurred, pixels without albedo are kept
+func demodulate(canvas, albedo []Color, multiply bool) []Color {
+	if albedo == nil {
+		return canvas
+	}
+	out := make([]Color, len(canvas))
+	divide := func(v, a float64) float64 {
+		if a < 0.01 {
+			return v
+		} else if multiply {
+			return v * a
+		}
+		return v / a
+	}
+	for i, c := range canvas {
+		a := albedo[i]
+		out[i] = Color{divide(c.r, a.r), divide(c.g, a.g), divide(c.b, a.b)}
+	}
+	return out
+}
+
+// denoise returns filtered canvas, pixels are averaged with pixels of similar patches and guides within the window
+func (d Denoiser) denoise(canvas, albedo, normal, depth []Color, width, height int) []Color {
+	irradiance := demodulate(canvas, albedo, false)
+	filtered := make([]Color, len(canvas))
+	// pixels at the border of the window are weighted down by exp(-2)
+	spatial := float64(d.radius*d.radius) / 2
+	patchSize := float64((2*d.patch + 1) * (2*d.patch + 1))
+
+	// distance of colors is relative to their brightness, so that dark and bright areas are denoised alike
+	distance := func(a, b Color) float64 {
+		dr, dg, db := a.r-b.r, a.g-b.g, a.b-b.b
+		return (dr*dr + dg*dg + db*db) / (0.01 + a.r*a.r + a.g*a.g + a.b*a.b + b.r*b.r + b.g*b.g + b.b*b.b)
+	}
+	pixel := func(x, y int) {
+		p := y*width + x
+		sum, total := Color{0, 0, 0}, 0.0
+		for qy := y - d.radius; qy <= y+d.radius; qy++ {
+			if qy < 0 || qy >= height {
+				continue
+			}
+			for qx := x - d.radius; qx <= x+d.radius; qx++ {
+				if qx < 0 || qx >= width {
+					continue
+				}
+				q := qy*width + qx
+				dx, dy := float64(qx-x), float64(qy-y)
+				e := (dx*dx + dy*dy) / spatial
+				if normal != nil {
+					n := normal[p].Subtract(normal[q])
+					e += (n.r*n.r + n.g*n.g + n.b*n.b) / (d.normal * d.normal)
+				}
+				if depth != nil {
+					z := (depth[p].r - depth[q].r) / (d.depth*depth[p].r + 1e-3)
+					e += z * z
+				}
+				if albedo != nil {
+					a := albedo[p].Subtract(albedo[q])
+					e += (a.r*a.r + a.g*a.g + a.b*a.b) / (d.albedo * d.albedo)
+				}
+				if e > 10 {
+					continue
+				}
+				patch := 0.0
+				for oy := -d.patch; oy <= d.patch; oy++ {
+					for ox := -d.patch; ox <= d.patch; ox++ {
+						// patches are clamped at the border
+						ay, by := clampInt(y+oy, 0, height-1), clampInt(qy+oy, 0, height-1)
+						ax, bx := clampInt(x+ox, 0, width-1), clampInt(qx+ox, 0, width-1)
+						patch += distance(irradiance[ay*width+ax], irradiance[by*width+bx])
+					}
+				}
+				e += patch / patchSize / (d.strength * d.strength)
+				w := math.Exp(-e)
+				sum = sum.Add(irradiance[q].MulScalar(w))
+				total += w
+			}
+		}
+		filtered[p] = sum.DivScalar(total)
+	}
+
+	// rows are shared by all cores
+	rows := make(chan int, height)
+	for y := 0; y < height; y++ {
+		rows <- y
+	}
+	close(rows)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y := range rows {
+				for x := 0; x < width; x++ {
+					pixel(x, y)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return demodulate(filtered, albedo, true)
+}
+
+func clampInt(v, low, high int) int {
+	if v < low {
+		return low
+	} else if v > high {
+		return high
+	}
+	return v
+}
+
+// guides returns albedo, normal and depth AOVs from rendered AOVs, missing ones are nil
+func guides(aovs [][]Color, kinds []int) ([]Color, []Color, []Color) {
+	found := map[int][]Color{}
+	for k, kind := range kinds {
+		found[kind] = aovs[k]
+	}
+	return found[AlbedoAOV], found[NormalAOV], found[DepthAOV]
+}
+
+// denoiseEXR denoises an EXR image with its guides saved as AOVs, applies post effects and writes it with _denoised suffix,
+// the image is written with the display encoding of config, but stays in its own working space
+func denoiseEXR(path string, d Denoiser, chain []Effect, extension, depth int, config ColorConfig, tone ToneMap) error {
+	m, err := LoadEXR(path)
+	if err != nil {
+		return err
+	}
+	canvas, ok := m.canvas("", "R", "G", "B")
+	if !ok {
+		return errors.New(path + ": no R, G and B channels")
+	}
+	albedo, _ := m.canvas(aovNames[AlbedoAOV], "R", "G", "B")
+	normal, _ := m.canvas(aovNames[NormalAOV], "X", "Y", "Z")
+	distance, _ := m.canvas(aovNames[DepthAOV], "Z", "Z", "Z")
+	config.working = m.working
+	denoised := applyEffects(d.denoise(canvas, albedo, normal, distance, m.width, m.height), m.width, m.height, chain, 0, config)
+	SaveImage(denoised, m.width, m.height, 255, strings.TrimSuffix(path, ".exr")+"_denoised", extension, depth, config, tone)
+	return nil
+}
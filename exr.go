@@ -0,0 +1,1114 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// compressions of EXR images, the values are the ones stored in the file
+const (
+	NoCompression  = 0
+	ZIPCompression = 3
+	PIZCompression = 4
+)
+
+// pixel types of EXR channels, the values are the ones stored in the file
+const (
+	HalfPixel  = 1
+	FloatPixel = 2
+)
+
+// exrCompression is the compression of saved EXR images
+var exrCompression = ZIPCompression
+
+// Layer is a named group of channels of an EXR image, channels of a layer without a name are stored without a prefix
+type Layer struct {
+	name     string
+	channels []string
+	values   [][]float64 // values of every channel, rows from the bottom like canvases
+}
+
+// exrChannel is a channel of an EXR image with its full name
+type exrChannel struct {
+	name   string
+	values []float64
+}
+
+// chromaticities of working spaces, red, green, blue and white point
+var exrChromaticities = map[int][8]float32{
+	LinearSRGB: {0.64, 0.33, 0.30, 0.60, 0.15, 0.06, 0.3127, 0.3290},
+	ACEScg:     {0.713, 0.293, 0.165, 0.830, 0.128, 0.044, 0.32168, 0.33767},
+}
+
+// colorLayer returns layer with linear RGB channels of canvas
+func colorLayer(name string, canvas []Color) Layer {
+	l := Layer{name, []string{"R", "G", "B"}, [][]float64{make([]float64, len(canvas)), make([]float64, len(canvas)), make([]float64, len(canvas))}}
+	for i, c := range canvas {
+		l.values[0][i], l.values[1][i], l.values[2][i] = c.r, c.g, c.b
+	}
+	return l
+}
+
+// SaveEXR writes layers into a single part scanline EXR file, values are linear in the working space of config
+func SaveEXR(layers []Layer, width, height int, fileName string, pixelType, compression int, config ColorConfig) error {
+	var channels []exrChannel
+	longNames := false
+	for _, l := range layers {
+		for i, c := range l.channels {
+			name := c
+			if l.name != "" {
+				name = l.name + "." + c
+			}
+			longNames = longNames || len(name) > 31
+			channels = append(channels, exrChannel{name, l.values[i]})
+		}
+	}
+	// readers expect channels sorted by name
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].name < channels[j].name
+	})
+
+	header := &bytes.Buffer{}
+	header.Write([]byte{0x76, 0x2f, 0x31, 0x01})
+	version := uint32(2)
+	if longNames {
+		version |= 0x400
+	}
+	binary.Write(header, binary.LittleEndian, version)
+
+	list := &bytes.Buffer{}
+	for _, c := range channels {
+		list.WriteString(c.name)
+		list.WriteByte(0)
+		binary.Write(list, binary.LittleEndian, []int32{int32(pixelType), 0, 1, 1})
+	}
+	list.WriteByte(0)
+	exrAttribute(header, "channels", "chlist", list.Bytes())
+	exrAttribute(header, "compression", "compression", []byte{byte(compression)})
+	window := exrValue([]int32{0, 0, int32(width - 1), int32(height - 1)})
+	exrAttribute(header, "dataWindow", "box2i", window)
+	exrAttribute(header, "displayWindow", "box2i", window)
+	exrAttribute(header, "lineOrder", "lineOrder", []byte{0})
+	exrAttribute(header, "pixelAspectRatio", "float", exrValue(float32(1)))
+	exrAttribute(header, "screenWindowCenter", "v2f", exrValue([]float32{0, 0}))
+	exrAttribute(header, "screenWindowWidth", "float", exrValue(float32(1)))
+	chromaticities := exrChromaticities[config.working]
+	exrAttribute(header, "chromaticities", "chromaticities", exrValue(chromaticities[:]))
+	header.WriteByte(0)
+
+	lines := 1
+	if compression == ZIPCompression {
+		lines = 16
+	} else if compression == PIZCompression {
+		lines = 32
+	}
+	size := 2
+	if pixelType == FloatPixel {
+		size = 4
+	}
+	sizes := make([]int, len(channels))
+	for i := range sizes {
+		sizes[i] = size / 2
+	}
+
+	// every block of lines is stored as a chunk with the first line and the size of its data, lines are counted from the top
+	blocks := (height + lines - 1) / lines
+	chunks := &bytes.Buffer{}
+	offsets := make([]uint64, blocks)
+	start := uint64(header.Len() + 8*blocks)
+	for b := 0; b < blocks; b++ {
+		y0 := b * lines
+		y1 := y0 + lines
+		if y1 > height {
+			y1 = height
+		}
+		raw := make([]byte, 0, (y1-y0)*width*size*len(channels))
+		for y := y0; y < y1; y++ {
+			row := (height - 1 - y) * width
+			for _, c := range channels {
+				for x := 0; x < width; x++ {
+					if pixelType == FloatPixel {
+						raw = binary.LittleEndian.AppendUint32(raw, math.Float32bits(float32(c.values[row+x])))
+					} else {
+						raw = binary.LittleEndian.AppendUint16(raw, halfBits(c.values[row+x]))
+					}
+				}
+			}
+		}
+		data := raw
+		if compression == ZIPCompression {
+			data = zipCompress(raw)
+		} else if compression == PIZCompression {
+			data = pizCompress(raw, width, y1-y0, sizes)
+		}
+		// data that does not get smaller is stored uncompressed
+		if len(data) >= len(raw) {
+			data = raw
+		}
+		offsets[b] = start + uint64(chunks.Len())
+		binary.Write(chunks, binary.LittleEndian, []int32{int32(y0), int32(len(data))})
+		chunks.Write(data)
+	}
+
+	f, err := os.Create(fileName + ".exr")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(header.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := binary.Write(f, binary.LittleEndian, offsets); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(chunks.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func exrAttribute(b *bytes.Buffer, name, kind string, value []byte) {
+	b.WriteString(name)
+	b.WriteByte(0)
+	b.WriteString(kind)
+	b.WriteByte(0)
+	binary.Write(b, binary.LittleEndian, int32(len(value)))
+	b.Write(value)
+}
+
+// exrValue returns little endian bytes of a fixed size value
+func exrValue(v interface{}) []byte {
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.LittleEndian, v)
+	return b.Bytes()
+}
+
+// halfBits converts value into bits of a 16 bit float rounded to the nearest even, values out of the range become infinity
+func halfBits(v float64) uint16 {
+	f := math.Float32bits(float32(v))
+	sign := uint16(f>>16) & 0x8000
+	exponent := int(f>>23) & 0xff
+	mantissa := f & 0x7fffff
+	if exponent == 0xff {
+		if mantissa != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	}
+	e := exponent - 127 + 15
+	if e >= 31 {
+		return sign | 0x7c00
+	}
+	if e <= 0 {
+		// subnormal halves
+		if e < -10 {
+			return sign
+		}
+		mantissa |= 0x800000
+		shift := uint(14 - e)
+		half := mantissa >> shift
+		rest, middle := mantissa&(1<<shift-1), uint32(1)<<(shift-1)
+		if rest > middle || (rest == middle && half&1 == 1) {
+			half++
+		}
+		return sign | uint16(half)
+	}
+	// rounding up may carry into the exponent, which is the correct result up to infinity
+	half := uint32(e)<<10 | mantissa>>13
+	rest := mantissa & 0x1fff
+	if rest > 0x1000 || (rest == 0x1000 && half&1 == 1) {
+		half++
+	}
+	return sign | uint16(half)
+}
+
+// zipCompress splits bytes into halves of even and odd bytes, replaces them with differences and deflates them
+func zipCompress(raw []byte) []byte {
+	t := make([]byte, len(raw))
+	half := (len(raw) + 1) / 2
+	for i, v := range raw {
+		if i%2 == 0 {
+			t[i/2] = v
+		} else {
+			t[half+i/2] = v
+		}
+	}
+	for i := len(t) - 1; i > 0; i-- {
+		t[i] = t[i] - t[i-1] + 128
+	}
+	b := &bytes.Buffer{}
+	w := zlib.NewWriter(b)
+	w.Write(t)
+	w.Close()
+	return b.Bytes()
+}
+
+// pizCompress maps 16 bit words of the block to a dense range, transforms every channel with a wavelet and Huffman codes the result,
+// sizes are numbers of words of a value of every channel
+func pizCompress(raw []byte, width, lines int, sizes []int) []byte {
+	// words of a channel of all lines are kept together, so that the wavelet works on whole planes
+	words := make([]uint16, len(raw)/2)
+	starts := make([]int, len(sizes))
+	ends := make([]int, len(sizes))
+	n := 0
+	for c, size := range sizes {
+		starts[c], ends[c] = n, n
+		n += width * lines * size
+	}
+	p := 0
+	for y := 0; y < lines; y++ {
+		for c, size := range sizes {
+			for k := 0; k < width*size; k++ {
+				words[ends[c]] = binary.LittleEndian.Uint16(raw[p:])
+				ends[c]++
+				p += 2
+			}
+		}
+	}
+
+	// bitmap of used words, zero is assumed to be always used
+	bitmap := make([]byte, 8192)
+	for _, w := range words {
+		bitmap[w>>3] |= 1 << (w & 7)
+	}
+	bitmap[0] &^= 1
+	minNonZero, maxNonZero := len(bitmap)-1, 0
+	for i, b := range bitmap {
+		if b != 0 {
+			if i < minNonZero {
+				minNonZero = i
+			}
+			maxNonZero = i
+		}
+	}
+	lut := make([]uint16, 1<<16)
+	k := 0
+	for i := range lut {
+		if i == 0 || bitmap[i>>3]&(1<<(i&7)) != 0 {
+			lut[i] = uint16(k)
+			k++
+		}
+	}
+	maxValue := uint16(k - 1)
+	for i, w := range words {
+		words[i] = lut[w]
+	}
+
+	out := exrValue([]uint16{uint16(minNonZero), uint16(maxNonZero)})
+	if minNonZero <= maxNonZero {
+		out = append(out, bitmap[minNonZero:maxNonZero+1]...)
+	}
+	for c, size := range sizes {
+		for j := 0; j < size; j++ {
+			wav2Encode(words[starts[c]+j:], width, size, lines, width*size, maxValue)
+		}
+	}
+	huffman := hufCompress(words)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(huffman)))
+	return append(out, huffman...)
+}
+
+// wenc14 is the wavelet of two values when all values fit in 14 bits
+func wenc14(a, b uint16) (uint16, uint16) {
+	as, bs := int(int16(a)), int(int16(b))
+	return uint16((as + bs) >> 1), uint16(as - bs)
+}
+
+// wenc16 is the wavelet of two values modulo 2^16
+func wenc16(a, b uint16) (uint16, uint16) {
+	ao := (int(a) + 1<<15) & 0xffff
+	m := (ao + int(b)) >> 1
+	d := ao - int(b)
+	if d < 0 {
+		m = (m + 1<<15) & 0xffff
+	}
+	return uint16(m), uint16(d & 0xffff)
+}
+
+// wav2Encode is the 2D Haar wavelet of nx by ny values at offsets ox and oy from each other, done in place
+func wav2Encode(in []uint16, nx, ox, ny, oy int, maxValue uint16) {
+	encode := wenc16
+	if maxValue < 1<<14 {
+		encode = wenc14
+	}
+	n := nx
+	if ny < n {
+		n = ny
+	}
+	for p, p2 := 1, 2; p2 <= n; p, p2 = p2, p2<<1 {
+		ey := oy * (ny - p2)
+		oy1, oy2 := oy*p, oy*p2
+		ox1, ox2 := ox*p, ox*p2
+		py := 0
+		for ; py <= ey; py += oy2 {
+			px := py
+			ex := py + ox*(nx-p2)
+			for ; px <= ex; px += ox2 {
+				p01 := px + ox1
+				p10 := px + oy1
+				p11 := p10 + ox1
+				i00, i01 := encode(in[px], in[p01])
+				i10, i11 := encode(in[p10], in[p11])
+				in[px], in[p10] = encode(i00, i10)
+				in[p01], in[p11] = encode(i01, i11)
+			}
+			// odd column
+			if nx&p != 0 {
+				p10 := px + oy1
+				in[px], in[p10] = encode(in[px], in[p10])
+			}
+		}
+		// odd line
+		if ny&p != 0 {
+			px := py
+			ex := py + ox*(nx-p2)
+			for ; px <= ex; px += ox2 {
+				p01 := px + ox1
+				in[px], in[p01] = encode(in[px], in[p01])
+			}
+		}
+	}
+}
+
+// hufEncodeSize is the number of symbols of the Huffman code, all 16 bit words and a symbol of runs
+const hufEncodeSize = 1<<16 + 1
+
+// bitWriter packs codes into bytes from the most significant bit
+type bitWriter struct {
+	c   uint64
+	lc  int
+	out []byte
+}
+
+func (w *bitWriter) bits(n int, bits uint64) {
+	w.c = w.c<<uint(n) | bits
+	w.lc += n
+	for w.lc >= 8 {
+		w.lc -= 8
+		w.out = append(w.out, byte(w.c>>uint(w.lc)))
+	}
+}
+
+// code writes code of the table, which has the length in the lowest 6 bits
+func (w *bitWriter) code(code uint64) {
+	w.bits(int(code&63), code>>6)
+}
+
+// flush writes the last incomplete byte and returns the number of written bits
+func (w *bitWriter) flush() int {
+	n := len(w.out)*8 + w.lc
+	if w.lc > 0 {
+		w.out = append(w.out, byte(w.c<<uint(8-w.lc)))
+	}
+	return n
+}
+
+// frequencyHeap orders symbols by their frequencies, the least frequent first
+type frequencyHeap struct {
+	frequencies []uint64
+	symbols     []int
+}
+
+func (h *frequencyHeap) Len() int { return len(h.symbols) }
+func (h *frequencyHeap) Less(i, j int) bool {
+	return h.frequencies[h.symbols[i]] < h.frequencies[h.symbols[j]]
+}
+func (h *frequencyHeap) Swap(i, j int)      { h.symbols[i], h.symbols[j] = h.symbols[j], h.symbols[i] }
+func (h *frequencyHeap) Push(x interface{}) { h.symbols = append(h.symbols, x.(int)) }
+func (h *frequencyHeap) Pop() interface{} {
+	x := h.symbols[len(h.symbols)-1]
+	h.symbols = h.symbols[:len(h.symbols)-1]
+	return x
+}
+
+// hufCompress is the Huffman coding of PIZ, runs of a word are coded as the word followed by the run symbol and the length
+func hufCompress(data []uint16) []byte {
+	codes := make([]uint64, hufEncodeSize)
+	for _, v := range data {
+		codes[v]++
+	}
+	im, iM := hufBuildEncodeTable(codes)
+	table := &bitWriter{}
+	hufPackEncodeTable(codes, im, iM, table)
+	table.flush()
+
+	encoded := &bitWriter{}
+	s, run := data[0], 0
+	for _, v := range data[1:] {
+		if v == s && run < 255 {
+			run++
+		} else {
+			hufSendCode(codes[s], run, codes[iM], encoded)
+			run = 0
+		}
+		s = v
+	}
+	hufSendCode(codes[s], run, codes[iM], encoded)
+	bits := encoded.flush()
+
+	out := exrValue([]uint32{uint32(im), uint32(iM), uint32(len(table.out)), uint32(bits), 0})
+	out = append(out, table.out...)
+	return append(out, encoded.out...)
+}
+
+// hufBuildEncodeTable replaces frequencies of symbols with canonical codes, returns the first and the last symbol,
+// which is the symbol of runs added after the used ones
+func hufBuildEncodeTable(frequencies []uint64) (int, int) {
+	im := 0
+	for frequencies[im] == 0 {
+		im++
+	}
+	// codes of symbols merged into a node are linked into a list ending with a symbol linked to itself
+	link := make([]int, hufEncodeSize)
+	h := &frequencyHeap{frequencies, nil}
+	iM := im
+	for i := im; i < hufEncodeSize; i++ {
+		link[i] = i
+		if frequencies[i] != 0 {
+			h.symbols = append(h.symbols, i)
+			iM = i
+		}
+	}
+	iM++
+	frequencies[iM] = 1
+	h.symbols = append(h.symbols, iM)
+	heap.Init(h)
+
+	lengths := make([]uint64, hufEncodeSize)
+	for h.Len() > 1 {
+		mm := heap.Pop(h).(int)
+		m := heap.Pop(h).(int)
+		frequencies[m] += frequencies[mm]
+		heap.Push(h, m)
+		for j := m; ; j = link[j] {
+			lengths[j]++
+			if link[j] == j {
+				link[j] = mm
+				break
+			}
+		}
+		for j := mm; ; j = link[j] {
+			lengths[j]++
+			if link[j] == j {
+				break
+			}
+		}
+	}
+
+	// canonical codes of every length follow each other, longer codes first
+	var counts [59]uint64
+	for _, l := range lengths {
+		counts[l]++
+	}
+	c := uint64(0)
+	for i := 58; i > 0; i-- {
+		next := (c + counts[i]) >> 1
+		counts[i] = c
+		c = next
+	}
+	for i, l := range lengths {
+		frequencies[i] = 0
+		if l > 0 {
+			frequencies[i] = l | counts[l]<<6
+			counts[l]++
+		}
+	}
+	return im, iM
+}
+
+// hufPackEncodeTable writes lengths of codes from im to iM with 6 bits, runs of unused symbols are shortened
+func hufPackEncodeTable(codes []uint64, im, iM int, w *bitWriter) {
+	const shortZeroRun, longZeroRun = 59, 63
+	const shortestLongRun = 2 + longZeroRun - shortZeroRun
+	const longestLongRun = 255 + shortestLongRun
+	for ; im <= iM; im++ {
+		l := codes[im] & 63
+		if l == 0 {
+			run := 1
+			for im < iM && run < longestLongRun && codes[im+1]&63 == 0 {
+				im++
+				run++
+			}
+			if run >= shortestLongRun {
+				w.bits(6, longZeroRun)
+				w.bits(8, uint64(run-shortestLongRun))
+				continue
+			} else if run >= 2 {
+				w.bits(6, uint64(shortZeroRun+run-2))
+				continue
+			}
+		}
+		w.bits(6, l)
+	}
+}
+
+// hufSendCode writes a symbol repeated run more times, as a run when that is shorter
+func hufSendCode(code uint64, run int, runCode uint64, w *bitWriter) {
+	length, runLength := int(code&63), int(runCode&63)
+	if length+runLength+8 < length*run {
+		w.code(code)
+		w.code(runCode)
+		w.bits(8, uint64(run))
+		return
+	}
+	for ; run >= 0; run-- {
+		w.code(code)
+	}
+}
+
+// EXRImage is a decoded EXR image with its layers and the working space given by its chromaticities
+type EXRImage struct {
+	width, height int
+	working       int
+	layers        []Layer
+}
+
+// layer returns the layer with the name and channels in the given order, missing channels make it absent
+func (m *EXRImage) layer(name string, channels ...string) ([][]float64, bool) {
+	for _, l := range m.layers {
+		if l.name != name {
+			continue
+		}
+		values := make([][]float64, len(channels))
+		for i, c := range channels {
+			for j := range l.channels {
+				if l.channels[j] == c {
+					values[i] = l.values[j]
+				}
+			}
+			if values[i] == nil {
+				return nil, false
+			}
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+// canvas returns three channels of the layer as a canvas
+func (m *EXRImage) canvas(name string, channels ...string) ([]Color, bool) {
+	values, ok := m.layer(name, channels...)
+	if !ok {
+		return nil, false
+	}
+	canvas := make([]Color, m.width*m.height)
+	for i := range canvas {
+		canvas[i] = Color{values[0][i], values[1][i], values[2][i]}
+	}
+	return canvas, true
+}
+
+// exrReader reads little endian values of the header and the offsets, running past the end is an error checked once
+type exrReader struct {
+	data []byte
+	p    int
+	err  error
+}
+
+// bytes returns the next n bytes, past the end zeros are returned for fixed size values, which are at most 32 bytes
+func (r *exrReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || r.p+n > len(r.data) {
+		r.err = errors.New("exr: unexpected end of file")
+		if n < 0 || n > 32 {
+			return nil
+		}
+		return make([]byte, n)
+	}
+	b := r.data[r.p : r.p+n]
+	r.p += n
+	return b
+}
+
+func (r *exrReader) string() string {
+	for i := r.p; i < len(r.data); i++ {
+		if r.data[i] == 0 {
+			s := string(r.data[r.p:i])
+			r.p = i + 1
+			return s
+		}
+	}
+	r.err = errors.New("exr: unexpected end of file")
+	return ""
+}
+
+func (r *exrReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.bytes(4))
+}
+
+// LoadEXR reads a single part scanline EXR image with any of no, RLE, ZIPS, ZIP and PIZ compression,
+// channels are grouped into layers by the name before their last dot
+func LoadEXR(fileName string) (*EXRImage, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	r := &exrReader{data, 0, nil}
+	if !bytes.Equal(r.bytes(4), []byte{0x76, 0x2f, 0x31, 0x01}) {
+		return nil, errors.New("exr: not an OpenEXR image")
+	}
+	version := r.uint32()
+	if version&0x200 != 0 || version&0x1000 != 0 || version&0x800 != 0 {
+		return nil, errors.New("exr: only single part scanline images are supported")
+	}
+
+	type channel struct {
+		name      string
+		pixelType int
+	}
+	var channels []channel
+	compression := -1
+	var x0, y0, x1, y1 int32
+	m := &EXRImage{working: LinearSRGB}
+	for r.err == nil {
+		name := r.string()
+		if name == "" {
+			break
+		}
+		r.string()
+		value := &exrReader{r.bytes(int(int32(r.uint32()))), 0, nil}
+		if name == "channels" {
+			for value.err == nil {
+				c := value.string()
+				if c == "" {
+					break
+				}
+				pixelType := int(value.uint32())
+				value.bytes(4)
+				if value.uint32() != 1 || value.uint32() != 1 {
+					return nil, errors.New("exr: subsampled channels are not supported")
+				}
+				channels = append(channels, channel{c, pixelType})
+			}
+		} else if name == "compression" {
+			compression = int(value.bytes(1)[0])
+		} else if name == "dataWindow" {
+			x0, y0 = int32(value.uint32()), int32(value.uint32())
+			x1, y1 = int32(value.uint32()), int32(value.uint32())
+		} else if name == "chromaticities" {
+			var chromaticities [8]float32
+			binary.Read(bytes.NewReader(value.bytes(32)), binary.LittleEndian, &chromaticities)
+			for working, c := range exrChromaticities {
+				if c == chromaticities {
+					m.working = working
+				}
+			}
+		}
+		if value.err != nil {
+			return nil, value.err
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	m.width, m.height = int(x1-x0)+1, int(y1-y0)+1
+	if m.width <= 0 || m.height <= 0 || len(channels) == 0 || m.width*m.height > 1<<28 {
+		return nil, errors.New("exr: invalid header")
+	}
+	lines := 1
+	if compression == ZIPCompression {
+		lines = 16
+	} else if compression == PIZCompression {
+		lines = 32
+	} else if compression > PIZCompression || compression < NoCompression {
+		return nil, fmt.Errorf("exr: unsupported compression %d", compression)
+	}
+
+	// values of every channel are stored in the file from the top, in canvases from the bottom
+	sizes := make([]int, len(channels))
+	values := make([][]float64, len(channels))
+	for i, c := range channels {
+		if c.pixelType < 0 || c.pixelType > FloatPixel {
+			return nil, fmt.Errorf("exr: unsupported pixel type %d", c.pixelType)
+		}
+		sizes[i] = 2
+		if c.pixelType == HalfPixel {
+			sizes[i] = 1
+		}
+		values[i] = make([]float64, m.width*m.height)
+	}
+	blocks := (m.height + lines - 1) / lines
+	for b := 0; b < blocks; b++ {
+		offset := binary.LittleEndian.Uint64(r.bytes(8))
+		if r.err != nil || offset > uint64(len(data)) {
+			return nil, errors.New("exr: invalid offset")
+		}
+		chunk := &exrReader{data, int(offset), nil}
+		first := int(int32(chunk.uint32())) - int(y0)
+		packed := chunk.bytes(int(int32(chunk.uint32())))
+		if chunk.err != nil || first < 0 || first >= m.height || first%lines != 0 {
+			return nil, errors.New("exr: invalid chunk")
+		}
+		last := first + lines
+		if last > m.height {
+			last = m.height
+		}
+		size := 0
+		for _, s := range sizes {
+			size += 2 * s * m.width * (last - first)
+		}
+		raw := packed
+		if len(packed) < size {
+			if compression == ZIPCompression || compression == 2 {
+				raw, err = zipDecompress(packed, size)
+			} else if compression == 1 {
+				raw, err = rleDecompress(packed, size)
+			} else if compression == PIZCompression {
+				raw, err = pizDecompress(packed, m.width, last-first, sizes)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(raw) != size {
+			return nil, errors.New("exr: invalid chunk size")
+		}
+		p := 0
+		for y := first; y < last; y++ {
+			row := (m.height - 1 - y) * m.width
+			for i, c := range channels {
+				for x := 0; x < m.width; x++ {
+					if c.pixelType == HalfPixel {
+						values[i][row+x] = halfValue(binary.LittleEndian.Uint16(raw[p:]))
+					} else if c.pixelType == FloatPixel {
+						values[i][row+x] = float64(math.Float32frombits(binary.LittleEndian.Uint32(raw[p:])))
+					} else {
+						values[i][row+x] = float64(binary.LittleEndian.Uint32(raw[p:]))
+					}
+					p += 2 * sizes[i]
+				}
+			}
+		}
+	}
+
+	for i, c := range channels {
+		name, channelName := "", c.name
+		if dot := strings.LastIndex(c.name, "."); dot >= 0 {
+			name, channelName = c.name[:dot], c.name[dot+1:]
+		}
+		j := 0
+		for j < len(m.layers) && m.layers[j].name != name {
+			j++
+		}
+		if j == len(m.layers) {
+			m.layers = append(m.layers, Layer{name, nil, nil})
+		}
+		m.layers[j].channels = append(m.layers[j].channels, channelName)
+		m.layers[j].values = append(m.layers[j].values, values[i])
+	}
+	return m, nil
+}
+
+// halfValue converts bits of a 16 bit float into a value
+func halfValue(h uint16) float64 {
+	exponent := int(h>>10) & 0x1f
+	mantissa := float64(h & 0x3ff)
+	v := math.Ldexp(mantissa, -24)
+	if exponent == 0x1f {
+		v = math.Inf(1)
+		if mantissa != 0 {
+			v = math.NaN()
+		}
+	} else if exponent > 0 {
+		v = math.Ldexp(1024+mantissa, exponent-25)
+	}
+	if h&0x8000 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// zipDecompress inflates data, undoes the differences and interleaves the halves of even and odd bytes
+func zipDecompress(data []byte, size int) ([]byte, error) {
+	z, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	t, err := io.ReadAll(io.LimitReader(z, int64(size)+1))
+	if err != nil {
+		return nil, err
+	}
+	return interleave(t, size)
+}
+
+// rleDecompress expands runs, a negative count is followed by that many literal bytes and others by a byte repeated count+1 times
+func rleDecompress(data []byte, size int) ([]byte, error) {
+	t := make([]byte, 0, size)
+	for p := 0; p < len(data) && len(t) <= size; {
+		count := int(int8(data[p]))
+		p++
+		if count < 0 {
+			if p-count > len(data) {
+				return nil, errors.New("exr: invalid run")
+			}
+			t = append(t, data[p:p-count]...)
+			p -= count
+		} else {
+			if p >= len(data) {
+				return nil, errors.New("exr: invalid run")
+			}
+			for ; count >= 0; count-- {
+				t = append(t, data[p])
+			}
+			p++
+		}
+	}
+	return interleave(t, size)
+}
+
+// interleave undoes the predictor and the split of bytes shared by ZIP and RLE compression
+func interleave(t []byte, size int) ([]byte, error) {
+	if len(t) != size {
+		return nil, errors.New("exr: invalid chunk size")
+	}
+	for i := 1; i < len(t); i++ {
+		t[i] = t[i-1] + t[i] - 128
+	}
+	raw := make([]byte, size)
+	half := (size + 1) / 2
+	for i := range raw {
+		if i%2 == 0 {
+			raw[i] = t[i/2]
+		} else {
+			raw[i] = t[half+i/2]
+		}
+	}
+	return raw, nil
+}
+
+// pizDecompress is the inverse of pizCompress
+func pizDecompress(data []byte, width, lines int, sizes []int) ([]byte, error) {
+	r := &exrReader{data, 0, nil}
+	minNonZero := int(binary.LittleEndian.Uint16(r.bytes(2)))
+	maxNonZero := int(binary.LittleEndian.Uint16(r.bytes(2)))
+	bitmap := make([]byte, 8192)
+	if minNonZero <= maxNonZero {
+		if maxNonZero >= len(bitmap) {
+			return nil, errors.New("exr: invalid bitmap")
+		}
+		copy(bitmap[minNonZero:], r.bytes(maxNonZero-minNonZero+1))
+	}
+	lut := make([]uint16, 1<<16)
+	k := 0
+	for i := range lut {
+		if i == 0 || bitmap[i>>3]&(1<<(i&7)) != 0 {
+			lut[k] = uint16(i)
+			k++
+		}
+	}
+	maxValue := uint16(k - 1)
+	huffman := r.bytes(int(int32(r.uint32())))
+	if r.err != nil {
+		return nil, r.err
+	}
+	n := 0
+	for _, size := range sizes {
+		n += width * lines * size
+	}
+	words, err := hufDecompress(huffman, n)
+	if err != nil {
+		return nil, err
+	}
+	starts := make([]int, len(sizes))
+	start := 0
+	for c, size := range sizes {
+		starts[c] = start
+		for j := 0; j < size; j++ {
+			wav2Decode(words[start+j:], width, size, lines, width*size, maxValue)
+		}
+		start += width * lines * size
+	}
+	raw := make([]byte, 0, 2*n)
+	for y := 0; y < lines; y++ {
+		for c, size := range sizes {
+			for k := 0; k < width*size; k++ {
+				raw = binary.LittleEndian.AppendUint16(raw, lut[words[starts[c]]])
+				starts[c]++
+			}
+		}
+	}
+	return raw, nil
+}
+
+// wdec14 is the inverse of wenc14
+func wdec14(l, h uint16) (uint16, uint16) {
+	hs := int(int16(h))
+	a := int(int16(l)) + (hs & 1) + (hs >> 1)
+	return uint16(a), uint16(a - hs)
+}
+
+// wdec16 is the inverse of wenc16
+func wdec16(l, h uint16) (uint16, uint16) {
+	b := (int(l) - int(h>>1)) & 0xffff
+	a := (int(h) + b - 1<<15) & 0xffff
+	return uint16(a), uint16(b)
+}
+
+// wav2Decode is the inverse of wav2Encode
+func wav2Decode(in []uint16, nx, ox, ny, oy int, maxValue uint16) {
+	decode := wdec16
+	if maxValue < 1<<14 {
+		decode = wdec14
+	}
+	n := nx
+	if ny < n {
+		n = ny
+	}
+	p := 1
+	for p <= n {
+		p <<= 1
+	}
+	p >>= 1
+	p2 := p
+	for p >>= 1; p >= 1; p2, p = p, p>>1 {
+		ey := oy * (ny - p2)
+		oy1, oy2 := oy*p, oy*p2
+		ox1, ox2 := ox*p, ox*p2
+		py := 0
+		for ; py <= ey; py += oy2 {
+			px := py
+			ex := py + ox*(nx-p2)
+			for ; px <= ex; px += ox2 {
+				p01 := px + ox1
+				p10 := px + oy1
+				p11 := p10 + ox1
+				i00, i10 := decode(in[px], in[p10])
+				i01, i11 := decode(in[p01], in[p11])
+				in[px], in[p01] = decode(i00, i01)
+				in[p10], in[p11] = decode(i10, i11)
+			}
+			// odd column
+			if nx&p != 0 {
+				p10 := px + oy1
+				in[px], in[p10] = decode(in[px], in[p10])
+			}
+		}
+		// odd line
+		if ny&p != 0 {
+			px := py
+			ex := py + ox*(nx-p2)
+			for ; px <= ex; px += ox2 {
+				p01 := px + ox1
+				in[px], in[p01] = decode(in[px], in[p01])
+			}
+		}
+	}
+}
+
+// bitReader reads bits from the most significant bit
+type bitReader struct {
+	data []byte
+	p    int // position in bits
+}
+
+func (r *bitReader) bits(n int) (uint64, bool) {
+	if r.p+n > 8*len(r.data) {
+		return 0, false
+	}
+	v := uint64(0)
+	for ; n > 0; n-- {
+		v = v<<1 | uint64(r.data[r.p>>3]>>(7-uint(r.p&7))&1)
+		r.p++
+	}
+	return v, true
+}
+
+// hufDecompress is the inverse of hufCompress, canonical codes are decoded by their length from the shortest
+func hufDecompress(data []byte, n int) ([]uint16, error) {
+	const shortZeroRun, longZeroRun = 59, 63
+	invalid := errors.New("exr: invalid Huffman code")
+	r := &exrReader{data, 0, nil}
+	im, iM := int(r.uint32()), int(r.uint32())
+	tableLength, bits := int(r.uint32()), int(r.uint32())
+	r.uint32()
+	table := r.bytes(tableLength)
+	if r.err != nil || im < 0 || iM >= hufEncodeSize || im > iM || bits < 0 || (bits+7)/8 > len(data)-r.p {
+		return nil, invalid
+	}
+
+	lengths := make([]uint64, hufEncodeSize)
+	t := &bitReader{table, 0}
+	for i := im; i <= iM; i++ {
+		l, ok := t.bits(6)
+		if !ok {
+			return nil, invalid
+		}
+		run := 0
+		if l == longZeroRun {
+			z, ok := t.bits(8)
+			if !ok {
+				return nil, invalid
+			}
+			run = int(z) + 2 + longZeroRun - shortZeroRun
+		} else if l >= shortZeroRun {
+			run = int(l) - shortZeroRun + 2
+		} else {
+			lengths[i] = l
+			continue
+		}
+		if i+run > iM+1 {
+			return nil, invalid
+		}
+		i += run - 1
+	}
+
+	// codes of a length start at the value following the longer codes, symbols of a length are in order
+	var counts, starts [59]uint64
+	symbols := [59][]int{}
+	for i, l := range lengths {
+		if l > 0 {
+			counts[l]++
+			symbols[l] = append(symbols[l], i)
+		}
+	}
+	c := uint64(0)
+	for i := 58; i > 0; i-- {
+		starts[i] = c
+		c = (c + counts[i]) >> 1
+	}
+
+	out := make([]uint16, 0, n)
+	d := &bitReader{data[r.p:], 0}
+	for d.p < bits {
+		code, length := uint64(0), 0
+		for {
+			b, ok := d.bits(1)
+			if !ok || length == 58 {
+				return nil, invalid
+			}
+			code = code<<1 | b
+			length++
+			if code >= starts[length] && code < starts[length]+counts[length] {
+				break
+			}
+		}
+		symbol := symbols[length][code-starts[length]]
+		if symbol == iM {
+			run, ok := d.bits(8)
+			if !ok || len(out) == 0 || len(out)+int(run) > n {
+				return nil, invalid
+			}
+			for ; run > 0; run-- {
+				out = append(out, out[len(out)-1])
+			}
+		} else if len(out) < n {
+			out = append(out, uint16(symbol))
+		} else {
+			return nil, invalid
+		}
+	}
+	if len(out) != n {
+		return nil, invalid
+	}
+	return out, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// reconstruction filters of pixels
+const (
+	BoxFilter = iota
+	TentFilter
+	GaussianFilter
+	MitchellFilter
+	BlackmanHarrisFilter
+)
+
+// filterTable is the number of steps of the table used for importance sampling of filters
+const filterTable = 256
+
+// Filter weighs samples by their distance from the center of a pixel in pixels, it is separable,
+// so the weight is a product of the profile in x and y
+type Filter struct {
+	kind   int
+	radius float64
+	cdf    []float64 // integral of the absolute value of the profile from -radius, used for importance sampling
+}
+
+// filterWidths are default widths of filters in pixels
+var filterWidths = map[int]float64{BoxFilter: 1, TentFilter: 2, GaussianFilter: 3, MitchellFilter: 4, BlackmanHarrisFilter: 3}
+
+// getFilter returns filter of given width in pixels, zero width selects the default width of the filter
+func getFilter(kind int, width float64) Filter {
+	if width <= 0 {
+		width = filterWidths[kind]
+	}
+	f := Filter{kind, width / 2, make([]float64, filterTable+1)}
+	step := 2 * f.radius / filterTable
+	for i := 1; i <= filterTable; i++ {
+		x := -f.radius + (float64(i)-0.5)*step
+		f.cdf[i] = f.cdf[i-1] + math.Abs(f.profile(x))*step
+	}
+	return f
+}
+
+// margin is the number of pixels around a pixel reached by samples of the pixel
+func (f Filter) margin() int {
+	return int(math.Ceil(f.radius - 0.5))
+}
+
+func (f Filter) profile(x float64) float64 {
+	x = math.Abs(x)
+	if x > f.radius {
+		return 0
+	}
+	if f.kind == TentFilter {
+		return 1 - x/f.radius
+	} else if f.kind == GaussianFilter {
+		// the gaussian is shifted to reach zero at the radius
+		sigma := f.radius / 3
+		return math.Exp(-x*x/(2*sigma*sigma)) - math.Exp(-f.radius*f.radius/(2*sigma*sigma))
+	} else if f.kind == MitchellFilter {
+		// Mitchell-Netravali with B = C = 1/3 stretched over the radius
+		const b, c = 1.0 / 3, 1.0 / 3
+		t := 2 * x / f.radius
+		if t < 1 {
+			return ((12-9*b-6*c)*t*t*t + (-18+12*b+6*c)*t*t + (6 - 2*b)) / 6
+		}
+		return ((-b-6*c)*t*t*t + (6*b+30*c)*t*t + (-12*b-48*c)*t + (8*b + 24*c)) / 6
+	} else if f.kind == BlackmanHarrisFilter {
+		n := (x + f.radius) / (2 * f.radius)
+		return 0.35875 - 0.48829*math.Cos(2*math.Pi*n) + 0.14128*math.Cos(4*math.Pi*n) - 0.01168*math.Cos(6*math.Pi*n)
+	}
+	return 1
+}
+
+// evaluate returns weight of a sample at offset dx, dy from the center of a pixel
+func (f Filter) evaluate(dx, dy float64) float64 {
+	return f.profile(dx) * f.profile(dy)
+}
+
+// sample maps a number in range [0, 1) to an offset distributed by the absolute value of the profile,
+// returns the offset and the sign of the profile at it
+func (f Filter) sample(u float64) (float64, float64) {
+	target := u * f.cdf[filterTable]
+	i := sort.SearchFloat64s(f.cdf, target)
+	if i < 1 {
+		i = 1
+	} else if i > filterTable {
+		i = filterTable
+	}
+	t := 0.0
+	if width := f.cdf[i] - f.cdf[i-1]; width > 0 {
+		t = (target - f.cdf[i-1]) / width
+	}
+	step := 2 * f.radius / filterTable
+	x := -f.radius + (float64(i-1)+t)*step
+	if f.profile(x) < 0 {
+		return x, -1
+	}
+	return x, 1
+}
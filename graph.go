@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+)
+
+// Node is an element of a texture graph evaluated at a hit point, Texture is a leaf node
+type Node interface {
+	color(rec HitRecord) Color
+}
+
+// AddNode sums colors of two nodes
+type AddNode struct {
+	a, b Node
+}
+
+// MulNode multiplies colors of two nodes
+type MulNode struct {
+	a, b Node
+}
+
+// MixNode linearly interpolates between two nodes by value of factor node
+type MixNode struct {
+	a, b, factor Node
+}
+
+// InvertNode returns one minus the color of the input
+type InvertNode struct {
+	input Node
+}
+
+// RemapNode linearly maps input from range [fromMin, fromMax] to [toMin, toMax]
+type RemapNode struct {
+	input                          Node
+	fromMin, fromMax, toMin, toMax float64
+}
+
+// RampNode maps value of the factor node through a color ramp
+type RampNode struct {
+	factor Node
+	stops  []RampStop
+}
+
+// UVTransformNode evaluates input with scaled, rotated and offset texture coordinates
+type UVTransformNode struct {
+	input                                   Node
+	scaleU, scaleV, offsetU, offsetV, angle float64
+}
+
+// scalar returns average of color channels of the node, used for grayscale parameters
+func scalar(n Node, rec HitRecord) float64 {
+	c := n.color(rec)
+	return (c.r + c.g + c.b) / 3
+}
+
+func (n AddNode) color(rec HitRecord) Color {
+	return n.a.color(rec).Add(n.b.color(rec))
+}
+
+func (n MulNode) color(rec HitRecord) Color {
+	return n.a.color(rec).Mul(n.b.color(rec))
+}
+
+func (n MixNode) color(rec HitRecord) Color {
+	f := scalar(n.factor, rec)
+	return n.a.color(rec).MulScalar(1 - f).Add(n.b.color(rec).MulScalar(f))
+}
+
+func (n InvertNode) color(rec HitRecord) Color {
+	return Color{1, 1, 1}.Subtract(n.input.color(rec))
+}
+
+func (n RemapNode) color(rec HitRecord) Color {
+	c := n.input.color(rec)
+	scale := (n.toMax - n.toMin) / (n.fromMax - n.fromMin)
+	return Color{
+		n.toMin + (c.r-n.fromMin)*scale,
+		n.toMin + (c.g-n.fromMin)*scale,
+		n.toMin + (c.b-n.fromMin)*scale,
+	}
+}
+
+func (n RampNode) color(rec HitRecord) Color {
+	return evalRamp(n.stops, scalar(n.factor, rec), rec)
+}
+
+func (n UVTransformNode) color(rec HitRecord) Color {
+	sin, cos := math.Sincos(n.angle)
+	u := rec.u*cos - rec.v*sin
+	v := rec.u*sin + rec.v*cos
+	rec.u = u*n.scaleU + n.offsetU
+	rec.v = v*n.scaleV + n.offsetV
+	return n.input.color(rec)
+}
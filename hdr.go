@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// HDRImage is a decoded Radiance HDR or PFM image with linear values, rows from the top like other images,
+// loadTexture reads its values directly so that values above 1 are kept
+type HDRImage struct {
+	width, height int
+	pixels        []Color
+}
+
+func init() {
+	image.RegisterFormat("hdr", "#?", decodeHDR, decodeHDRConfig)
+	image.RegisterFormat("pfm", "PF", decodePFM, decodePFMConfig)
+	image.RegisterFormat("pfm", "Pf", decodePFM, decodePFMConfig)
+}
+
+func (m *HDRImage) ColorModel() color.Model {
+	return color.RGBA64Model
+}
+
+func (m *HDRImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, m.width, m.height)
+}
+
+// At returns the pixel clamped and encoded with sRGB, for use as an ordinary image
+func (m *HDRImage) At(x, y int) color.Color {
+	if !image.Pt(x, y).In(m.Bounds()) {
+		return color.RGBA64{}
+	}
+	c := m.pixels[y*m.width+x]
+	encode := func(v float64) uint16 {
+		return uint16(math.Round(LinearToSRGB(math.Max(0, math.Min(1, v))) * 65535))
+	}
+	return color.RGBA64{encode(c.r), encode(c.g), encode(c.b), 65535}
+}
+
+// writeHDR writes canvas as Radiance RGBE with run length encoded scanlines, values are linear sRGB
+func writeHDR(w io.Writer, canvas []Color, width, height int) error {
+	if _, err := fmt.Fprintf(w, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", height, width); err != nil {
+		return err
+	}
+	line := make([]byte, 4*width)
+	for y := height - 1; y >= 0; y-- {
+		for x := 0; x < width; x++ {
+			rgbe := colorToRGBE(canvas[y*width+x])
+			for k := 0; k < 4; k++ {
+				line[k*width+x] = rgbe[k]
+			}
+		}
+		// only widths from 8 to 32767 can be run length encoded
+		if width < 8 || width > 0x7fff {
+			for x := 0; x < width; x++ {
+				if _, err := w.Write([]byte{line[x], line[width+x], line[2*width+x], line[3*width+x]}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if _, err := w.Write([]byte{2, 2, byte(width >> 8), byte(width)}); err != nil {
+			return err
+		}
+		for k := 0; k < 4; k++ {
+			if _, err := w.Write(rleRGBE(line[k*width : (k+1)*width])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// colorToRGBE stores color as three mantissas sharing an exponent
+func colorToRGBE(c Color) [4]byte {
+	c = Color{math.Max(0, c.r), math.Max(0, c.g), math.Max(0, c.b)}
+	v := math.Max(c.r, math.Max(c.g, c.b))
+	if v < 1e-32 {
+		return [4]byte{}
+	}
+	m, e := math.Frexp(v)
+	if e > 127 {
+		return [4]byte{255, 255, 255, 255}
+	}
+	scale := m * 256 / v
+	return [4]byte{byte(c.r * scale), byte(c.g * scale), byte(c.b * scale), byte(e + 128)}
+}
+
+// rleRGBE encodes one component of a scanline as runs of at least 4 equal bytes and literal bytes between them
+func rleRGBE(data []byte) []byte {
+	const minRun = 4
+	var out []byte
+	for cur := 0; cur < len(data); {
+		start, run, previous := cur, 0, 0
+		for run < minRun && start < len(data) {
+			start += run
+			previous = run
+			run = 1
+			for start+run < len(data) && run < 127 && data[start] == data[start+run] {
+				run++
+			}
+		}
+		// a short run right before the long one is written as a run too
+		if previous > 1 && previous == start-cur {
+			out = append(out, byte(128+previous), data[cur])
+			cur = start
+		}
+		for cur < start {
+			n := start - cur
+			if n > 128 {
+				n = 128
+			}
+			out = append(out, byte(n))
+			out = append(out, data[cur:cur+n]...)
+			cur += n
+		}
+		if run >= minRun {
+			out = append(out, byte(128+run), data[start])
+			cur += run
+		}
+	}
+	return out
+}
+
+// readHDRHeader reads the header of a Radiance HDR image up to and including the resolution
+func readHDRHeader(r *bufio.Reader) (int, int, error) {
+	first := true
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, 0, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if first && !strings.HasPrefix(line, "#?") {
+			return 0, 0, errors.New("hdr: not a Radiance image")
+		}
+		first = false
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return 0, 0, fmt.Errorf("hdr: unsupported %s", line)
+		}
+		if line == "" {
+			break
+		}
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	var width, height int
+	if _, err := fmt.Sscanf(line, "-Y %d +X %d", &height, &width); err != nil {
+		return 0, 0, fmt.Errorf("hdr: unsupported resolution %q", strings.TrimSpace(line))
+	}
+	// the size is limited like in EXR images, scanlines have four bytes per pixel
+	if width <= 0 || height <= 0 || width > 1<<28/height || 4*width > 1<<28 {
+		return 0, 0, errors.New("hdr: invalid size")
+	}
+	return width, height, nil
+}
+
+func decodeHDRConfig(r io.Reader) (image.Config, error) {
+	width, height, err := readHDRHeader(bufio.NewReader(r))
+	return image.Config{ColorModel: color.RGBA64Model, Width: width, Height: height}, err
+}
+
+// decodeHDR reads Radiance HDR with flat, old run length encoded or new run length encoded scanlines
+func decodeHDR(reader io.Reader) (image.Image, error) {
+	r := bufio.NewReader(reader)
+	width, height, err := readHDRHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &HDRImage{width, height, make([]Color, width*height)}
+	line := make([]byte, 4*width)
+	for y := 0; y < height; y++ {
+		start := make([]byte, 4)
+		if _, err := io.ReadFull(r, start); err != nil {
+			return nil, err
+		}
+		if width >= 8 && width <= 0x7fff && start[0] == 2 && start[1] == 2 && start[2]&0x80 == 0 {
+			if int(start[2])<<8|int(start[3]) != width {
+				return nil, errors.New("hdr: wrong scanline width")
+			}
+			for k := 0; k < 4; k++ {
+				component := line[k*width : (k+1)*width]
+				for x := 0; x < width; {
+					count, err := r.ReadByte()
+					if err != nil {
+						return nil, err
+					}
+					if count > 128 {
+						n := int(count) - 128
+						v, err := r.ReadByte()
+						if err != nil {
+							return nil, err
+						}
+						if x+n > width {
+							return nil, errors.New("hdr: bad run")
+						}
+						for ; n > 0; n-- {
+							component[x] = v
+							x++
+						}
+					} else {
+						n := int(count)
+						if n == 0 || x+n > width {
+							return nil, errors.New("hdr: bad run")
+						}
+						if _, err := io.ReadFull(r, component[x:x+n]); err != nil {
+							return nil, err
+						}
+						x += n
+					}
+				}
+			}
+			for x := 0; x < width; x++ {
+				m.pixels[y*width+x] = rgbeToColor(line[x], line[width+x], line[2*width+x], line[3*width+x])
+			}
+			continue
+		}
+		// flat pixels, where 1, 1, 1 repeats the previous pixel by the exponent shifted by the number of such pixels before
+		pixel := start
+		shift := uint(0)
+		for x := 0; x < width; {
+			if pixel[0] == 1 && pixel[1] == 1 && pixel[2] == 1 {
+				if x == 0 {
+					return nil, errors.New("hdr: run without a pixel")
+				}
+				n := int(pixel[3]) << shift
+				if x+n > width {
+					return nil, errors.New("hdr: bad run")
+				}
+				for ; n > 0; n-- {
+					m.pixels[y*width+x] = m.pixels[y*width+x-1]
+					x++
+				}
+				shift += 8
+			} else {
+				m.pixels[y*width+x] = rgbeToColor(pixel[0], pixel[1], pixel[2], pixel[3])
+				x++
+				shift = 0
+			}
+			if x < width {
+				if _, err := io.ReadFull(r, pixel); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+func rgbeToColor(r, g, b, e byte) Color {
+	if e == 0 {
+		return Color{0, 0, 0}
+	}
+	f := math.Ldexp(1, int(e)-(128+8))
+	return Color{(float64(r) + 0.5) * f, (float64(g) + 0.5) * f, (float64(b) + 0.5) * f}
+}
+
+// writePFM writes canvas as little endian portable float map, rows from the bottom, values are linear sRGB
+func writePFM(w io.Writer, canvas []Color, width, height int) error {
+	if _, err := fmt.Fprintf(w, "PF\n%d %d\n-1.0\n", width, height); err != nil {
+		return err
+	}
+	data := make([]float32, 0, 3*len(canvas))
+	for _, c := range canvas {
+		data = append(data, float32(c.r), float32(c.g), float32(c.b))
+	}
+	return binary.Write(w, binary.LittleEndian, data)
+}
+
+// readPFMHeader reads type, size and scale of a portable float map, a negative scale means little endian data
+func readPFMHeader(r *bufio.Reader) (int, int, int, float64, error) {
+	var kind string
+	var width, height int
+	var scale float64
+	if _, err := fmt.Fscan(r, &kind, &width, &height, &scale); err != nil {
+		return 0, 0, 0, 0, fmt.Errorf("pfm: %v", err)
+	}
+	// a single whitespace character separates the header from the data
+	if _, err := r.ReadByte(); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	channels := 3
+	if kind == "Pf" {
+		channels = 1
+	} else if kind != "PF" {
+		return 0, 0, 0, 0, errors.New("pfm: not a portable float map")
+	}
+	if width <= 0 || height <= 0 || width > 1<<28/height || scale == 0 {
+		return 0, 0, 0, 0, errors.New("pfm: invalid header")
+	}
+	return width, height, channels, scale, nil
+}
+
+func decodePFMConfig(r io.Reader) (image.Config, error) {
+	width, height, _, _, err := readPFMHeader(bufio.NewReader(r))
+	return image.Config{ColorModel: color.RGBA64Model, Width: width, Height: height}, err
+}
+
+func decodePFM(reader io.Reader) (image.Image, error) {
+	r := bufio.NewReader(reader)
+	width, height, channels, scale, err := readPFMHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if scale < 0 {
+		order = binary.LittleEndian
+	}
+	data := make([]float32, width*height*channels)
+	if err := binary.Read(r, order, data); err != nil {
+		return nil, err
+	}
+	m := &HDRImage{width, height, make([]Color, width*height)}
+	scale = math.Abs(scale)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// rows are stored from the bottom
+			v := data[((height-1-y)*width+x)*channels:]
+			c := Color{float64(v[0]), float64(v[0]), float64(v[0])}
+			if channels == 3 {
+				c = Color{float64(v[0]), float64(v[1]), float64(v[2])}
+			}
+			m.pixels[y*width+x] = c.MulScalar(scale)
+		}
+	}
+	return m, nil
+}
+
+// saveHDR writes canvas in the working space into a Radiance HDR or PFM file
+func saveHDR(canvas []Color, width, height int, fileName string, extension int, config ColorConfig) error {
+	linear := make([]Color, len(canvas))
+	for i := range canvas {
+		linear[i] = config.toLinearSRGB(canvas[i])
+	}
+	suffix := ".hdr"
+	if extension == PFM {
+		suffix = ".pfm"
+	}
+	f, err := os.Create(fileName + suffix)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if extension == PFM {
+		err = writePFM(w, linear, width, height)
+	} else {
+		err = writeHDR(w, linear, width, height)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -5,15 +5,20 @@ import (
 )
 
 type HitRecord struct {
-	u, v, t  float64
-	p        Tuple
-	normal   Tuple
-	material Material
+	u, v, t    float64
+	p          Tuple
+	normal     Tuple
+	material   Material
+	footprint  float64 // width of the ray cone at hit point
+	uvScale    float64 // change of texture coordinates per unit of distance on the surface
+	tangent    Tuple   // direction of increasing u, zero when unknown
+	handedness float64 // sign of the bitangent relative to normal x tangent
 }
 
 type HittableList struct {
 	sphereHits []Sphere
 	bvh        BVH
+	instances  *InstanceBVH
 }
 
 type AABB struct {
@@ -84,6 +89,11 @@ func (h *HittableList) hit(r Ray, tMin, tMax float64, rec *HitRecord) bool {
 			}
 		}
 	}
+
+	if h.instances.hit(r, tMin, closestSoFar, &tempRec) {
+		hitAnything = true
+		*rec = tempRec
+	}
 	return hitAnything
 }
 
@@ -116,9 +126,11 @@ func (s *Sphere) hit(r Ray, tMin, tMax float64, rec *HitRecord) bool {
 			*&rec.t = temp
 			*&rec.p = r.Position(rec.t)
 			*&rec.normal = (rec.p.Subtract(s.origin)).DivScalar(s.radius).Normalize()
-			if s.material.albedo.mode == CheckerboardUV || s.material.albedo.mode == ImageUV {
-				*&rec.u, *&rec.v = s.uv(*&rec.p)
-			}
+			*&rec.u, *&rec.v = s.uv(*&rec.p)
+			*&rec.footprint = r.width + r.spread*temp*r.direction.Magnitude()
+			*&rec.uvScale = 1 / (math.Pi * s.radius)
+			*&rec.tangent = Tuple{rec.normal.z, 0, -rec.normal.x, 0}
+			*&rec.handedness = 1
 			*&rec.material = s.material
 			return true
 		}
@@ -127,9 +139,11 @@ func (s *Sphere) hit(r Ray, tMin, tMax float64, rec *HitRecord) bool {
 			*&rec.t = temp
 			*&rec.p = r.Position(rec.t)
 			*&rec.normal = (rec.p.Subtract(s.origin)).DivScalar(s.radius).Normalize()
-			if s.material.albedo.mode == CheckerboardUV || s.material.albedo.mode == ImageUV {
-				*&rec.u, *&rec.v = s.uv(*&rec.p)
-			}
+			*&rec.u, *&rec.v = s.uv(*&rec.p)
+			*&rec.footprint = r.width + r.spread*temp*r.direction.Magnitude()
+			*&rec.uvScale = 1 / (math.Pi * s.radius)
+			*&rec.tangent = Tuple{rec.normal.z, 0, -rec.normal.x, 0}
+			*&rec.handedness = 1
 			*&rec.material = s.material
 			return true
 		}
@@ -166,6 +180,25 @@ func (tri *Triangle) hit(r Ray, tMin, tMax float64, rec *HitRecord) bool {
 		*&rec.material = tri.material
 		*&rec.u = u
 		*&rec.v = v
+		*&rec.footprint = r.width + r.spread*t*r.direction.Magnitude()
+		// barycentric coordinates span half of the unit square over the area of the triangle
+		*&rec.uvScale = 1 / math.Sqrt(edge1.Cross(edge2).Magnitude())
+		*&rec.tangent = Tuple{0, 0, 0, 0}
+		*&rec.handedness = 1
+		if tri.hasUV {
+			uv0 := tri.uvs.vertex0
+			uv1 := tri.uvs.vertex1
+			uv2 := tri.uvs.vertex2
+			*&rec.u = uv1.x*u + uv2.x*v + uv0.x*(1-u-v)
+			*&rec.v = uv1.y*u + uv2.y*v + uv0.y*(1-u-v)
+			uvArea := uv1.Subtract(uv0).Cross(uv2.Subtract(uv0)).Magnitude()
+			*&rec.uvScale = math.Sqrt(uvArea / edge1.Cross(edge2).Magnitude())
+			t0 := tri.tangents.vertex0
+			t1 := tri.tangents.vertex1
+			t2 := tri.tangents.vertex2
+			*&rec.tangent = t1.MulScalar(u).Add(t2.MulScalar(v)).Add(t0.MulScalar(1 - u - v))
+			*&rec.handedness = tri.handedness
+		}
 		if tri.smooth {
 			vn1 := tri.vnormals.vertex0
 			vn2 := tri.vnormals.vertex1
@@ -13,6 +13,9 @@ import (
 const (
 	PPM = iota
 	PNG
+	EXR
+	HDR
+	PFM
 )
 
 // checks if there's an error
@@ -22,26 +25,31 @@ func check(e error) {
 	}
 }
 
-func SaveImage(canvas []Color, width, height, maxValue int, fileName string, extension int, depth int) {
-	for y := height - 1; y >= 0; y-- {
-		for x := 0; x < width; x++ {
-			if canvas[y*width+x].r > 1.0 {
-				canvas[y*width+x].r = 1.0
-			}
-
-			if canvas[y*width+x].g > 1.0 {
-				canvas[y*width+x].g = 1.0
-			}
-
-			if canvas[y*width+x].b > 1.0 {
-				canvas[y*width+x].b = 1.0
-			}
+// SaveImage writes canvas into a file, EXR images keep linear values as halves with depth 16 or floats with depth 32,
+// HDR and PFM images keep linear values too, other formats are tone mapped, colors are in the working space of config
+func SaveImage(canvas []Color, width, height, maxValue int, fileName string, extension int, depth int, config ColorConfig, tone ToneMap) {
+	if extension == HDR || extension == PFM {
+		check(saveHDR(canvas, width, height, fileName, extension, config))
+		return
+	} else if extension == EXR {
+		pixelType := HalfPixel
+		if depth == 32 {
+			pixelType = FloatPixel
 		}
+		check(SaveEXR([]Layer{colorLayer("", canvas)}, width, height, fileName, pixelType, exrCompression, config))
+		return
+	}
+
+	// encoded values are kept separately so the canvas stays linear
+	encoded := make([]Color, len(canvas))
+	for i := range canvas {
+		encoded[i] = config.encode(canvas[i], tone)
 	}
 
 	if extension == PPM {
 		f, err := os.Create(fileName + ".ppm")
 		check(err)
+		defer f.Close()
 
 		w := bufio.NewWriter(f)
 		defer w.Flush()
@@ -49,9 +57,11 @@ func SaveImage(canvas []Color, width, height, maxValue int, fileName string, ext
 		_, err = fmt.Fprintf(w, "P3\n%d %d\n%d\n", width, height, maxValue)
 		check(err)
 
+		scale := float64(maxValue)
 		for y := height - 1; y >= 0; y-- {
 			for x := 0; x < width; x++ {
-				_, err := fmt.Fprintf(w, "%d %d %d ", int(math.Sqrt(canvas[y*width+x].r)*255), int(math.Sqrt(canvas[y*width+x].g)*255), int(math.Sqrt(canvas[y*width+x].b)*255))
+				c := encoded[y*width+x]
+				_, err := fmt.Fprintf(w, "%d %d %d ", int(math.Round(c.r*scale)), int(math.Round(c.g*scale)), int(math.Round(c.b*scale)))
 				check(err)
 			}
 			_, err := fmt.Fprint(w, "\n")
@@ -60,22 +70,30 @@ func SaveImage(canvas []Color, width, height, maxValue int, fileName string, ext
 	} else if extension == PNG {
 		f, err := os.Create(fileName + ".png")
 		check(err)
+		defer f.Close()
 		if depth == 8 {
-			image := image.NewRGBA(image.Rect(0, 0, width, height))
-			for y := height - 1; y >= 0; y-- {
-				for x := 0; x < width; x++ {
-					image.SetRGBA(x, height-1-y, color.RGBA{uint8(math.Sqrt(canvas[y*width+x].r) * 255.9), uint8(math.Sqrt(canvas[y*width+x].g) * 255.9), uint8(math.Sqrt(canvas[y*width+x].b) * 255.9), 255})
-				}
-			}
-			png.Encode(f, image)
+			check(png.Encode(f, rgbaImage(encoded, width, height)))
 		} else {
 			image := image.NewRGBA64(image.Rect(0, 0, width, height))
 			for y := height - 1; y >= 0; y-- {
 				for x := 0; x < width; x++ {
-					image.SetRGBA64(x, height-1-y, color.RGBA64{uint16(math.Sqrt(canvas[y*width+x].r) * 65535.9), uint16(math.Sqrt(canvas[y*width+x].g) * 65535.9), uint16(math.Sqrt(canvas[y*width+x].b) * 65535.9), 65535})
+					c := encoded[y*width+x]
+					image.SetRGBA64(x, height-1-y, color.RGBA64{uint16(math.Round(c.r * 65535)), uint16(math.Round(c.g * 65535)), uint16(math.Round(c.b * 65535)), 65535})
 				}
 			}
-			png.Encode(f, image)
+			check(png.Encode(f, image))
+		}
+	}
+}
+
+// rgbaImage returns encoded canvas as an 8 bit image with rows from the top
+func rgbaImage(encoded []Color, width, height int) *image.RGBA {
+	image := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := height - 1; y >= 0; y-- {
+		for x := 0; x < width; x++ {
+			c := encoded[y*width+x]
+			image.SetRGBA(x, height-1-y, color.RGBA{uint8(math.Round(c.r * 255)), uint8(math.Round(c.g * 255)), uint8(math.Round(c.b * 255)), 255})
 		}
 	}
+	return image
 }
@@ -2,16 +2,19 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"image"
 	"log"
 	"math"
-	"math/rand"
 	"os"
+	"os/signal"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -22,16 +25,32 @@ const (
 	depth   = 8
 )
 
-func colorize(r Ray, world *HittableList, d int, generator rand.Rand) Color {
+// colorize returns light coming along the ray, values of AOVs are recorded into sample unless it is nil
+func colorize(r Ray, world *HittableList, config ColorConfig, d int, generator *Sampler, sample *AOVSample) Color {
 	rec := HitRecord{}
 	if world.hit(r, Epsilon, math.MaxFloat64, &rec) {
+		rec.material.perturbNormal(&rec)
+		if sample != nil && d == 0 {
+			sample.record(r, rec)
+		}
+		generator.bounce(d)
 		var attenuation Color
 		var scattered Ray
-		if d < depth && rec.material.Scatter(r, rec, &attenuation, &scattered, generator) {
+		var specular bool
+		if d < depth && rec.material.Scatter(r, rec, &attenuation, &scattered, &specular, generator) {
 			if rec.material.material == Emission {
-				return rec.material.albedo.color(0, 0, rec.p)
+				emitted := rec.material.Emitted(r, rec, config)
+				if sample != nil && d == 0 {
+					sample.emission = emitted
+				} else if sample != nil && d == 1 {
+					sample.direct = true
+				}
+				return emitted
 			} else {
-				return attenuation.Mul(colorize(scattered, world, d+1, generator))
+				if sample != nil && d == 0 {
+					sample.specular = specular
+				}
+				return attenuation.Mul(colorize(scattered, world, config, d+1, generator, sample))
 			}
 		} else {
 			return Color{0, 0, 0}
@@ -47,8 +66,12 @@ func colorize(r Ray, world *HittableList, d int, generator rand.Rand) Color {
 func loadOBJ(file *os.File, list *[]Triangle, material Material, smooth bool) {
 	vertices := []Tuple{}
 	vertNormals := []Tuple{}
+	texCoords := []Tuple{}
 	faceVerts := []TrianglePosition{}
 	faceNormals := []TrianglePosition{}
+	faceUVs := []TrianglePosition{}
+	faceHasUV := []bool{}
+	faceIndices := [][3]int{}
 
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
@@ -69,6 +92,13 @@ func loadOBJ(file *os.File, list *[]Triangle, material Material, smooth bool) {
 				vertNormals = append(vertNormals, Tuple{
 					x, y, z, 0,
 				})
+			} else if text[0] == "vt" {
+				u, _ := strconv.ParseFloat(text[1], 64)
+				v, _ := strconv.ParseFloat(text[2], 64)
+				// images are stored top to bottom while OBJ texture coordinates start at the bottom
+				texCoords = append(texCoords, Tuple{
+					u, 1 - v, 0, 0,
+				})
 			} else if text[0] == "f" {
 				values1 := strings.Split(text[1], "/")
 				values2 := strings.Split(text[2], "/")
@@ -89,10 +119,40 @@ func loadOBJ(file *os.File, list *[]Triangle, material Material, smooth bool) {
 				faceNormals = append(faceNormals, TrianglePosition{
 					vertNormals[vn1-1], vertNormals[vn2-1], vertNormals[vn3-1],
 				})
+
+				faceIndices = append(faceIndices, [3]int{v1 - 1, v2 - 1, v3 - 1})
+
+				if values1[1] != "" && values2[1] != "" && values3[1] != "" {
+					vt1, _ := strconv.Atoi(values1[1])
+					vt2, _ := strconv.Atoi(values2[1])
+					vt3, _ := strconv.Atoi(values3[1])
+					faceUVs = append(faceUVs, TrianglePosition{
+						texCoords[vt1-1], texCoords[vt2-1], texCoords[vt3-1],
+					})
+					faceHasUV = append(faceHasUV, true)
+				} else {
+					faceUVs = append(faceUVs, TrianglePosition{})
+					faceHasUV = append(faceHasUV, false)
+				}
 			}
 		}
 	}
 
+	// tangents of faces sharing a vertex are averaged for smooth normal mapping
+	faceTangents := make([]Tuple, len(faceVerts))
+	handedness := make([]float64, len(faceVerts))
+	vertTangents := make([]Tuple, len(vertices))
+	for i := 0; i < len(faceVerts); i++ {
+		if !faceHasUV[i] {
+			continue
+		}
+		faceTangents[i], handedness[i] = uvTangent(faceVerts[i], faceUVs[i])
+		for _, index := range faceIndices[i] {
+			vertTangents[index] = vertTangents[index].Add(faceTangents[i])
+		}
+	}
+
+	first := len(*list)
 	for i := 0; i < len(faceVerts); i++ {
 		triangle := Triangle{
 			faceVerts[i],
@@ -100,14 +160,34 @@ func loadOBJ(file *os.File, list *[]Triangle, material Material, smooth bool) {
 			material,
 			Tuple{0, 0, 0, 0},
 			smooth,
+			faceUVs[i],
+			TrianglePosition{faceTangents[i], faceTangents[i], faceTangents[i]},
+			handedness[i],
+			faceHasUV[i],
 		}
 		vertex0 := faceNormals[i].vertex0
 		vertex1 := faceNormals[i].vertex1
 		vertex2 := faceNormals[i].vertex2
 		triangle.normal = (vertex0.Add(vertex1).Add(vertex2)).Normalize()
+		if smooth && faceHasUV[i] {
+			triangle.tangents = TrianglePosition{
+				vertTangents[faceIndices[i][0]], vertTangents[faceIndices[i][1]], vertTangents[faceIndices[i][2]],
+			}
+		}
 		*list = append(*list, triangle)
 	}
 
+	// emitters with normalized power are scaled by the area of the whole mesh
+	if material.material == Emission && material.emitter.normalize {
+		area := 0.0
+		for i := first; i < len(*list); i++ {
+			area += (*list)[i].area()
+		}
+		for i := first; i < len(*list); i++ {
+			(*list)[i].material = material.normalizeEmission(area)
+		}
+	}
+
 	if err := scanner.Err(); err != nil {
 		log.Fatal(err)
 	}
@@ -231,172 +311,437 @@ func getBVH(triangles []Triangle, depth, x int) *BVH {
 	}
 }
 
-func loadTexture(texture image.Image) [][]Color {
-	width := texture.Bounds().Dx()
-	height := texture.Bounds().Dy()
+// loadTexture converts image into texture in the working color space of config,
+// linear textures hold data like normals or roughness and are not decoded from sRGB
+func loadTexture(texture image.Image, linear bool, config ColorConfig) [][]Color {
+	bounds := texture.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
 	array := make([][]Color, width)
 	for i := 0; i < width; i++ {
 		array[i] = make([]Color, height)
 	}
 
+	// HDR images hold linear sRGB values that are not clamped
+	if hdr, ok := texture.(*HDRImage); ok {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				c := hdr.pixels[y*width+x]
+				if !linear {
+					c = config.fromLinearSRGB(c)
+				}
+				array[x][y] = c
+			}
+		}
+		return array
+	}
+
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
-			r, g, b, _ := texture.At(x, y).RGBA()
-			array[x][y] = Color{float64(r>>8) / 255, float64(g>>8) / 255, float64(b>>8) / 255}
+			r, g, b, a := texture.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			c := Color{float64(r) / 65535, float64(g) / 65535, float64(b) / 65535}
+			// colors returned by RGBA are premultiplied by alpha
+			if a > 0 && a < 65535 {
+				c = c.DivScalar(float64(a) / 65535)
+			}
+			if !linear {
+				c = config.fromLinearSRGB(Color{SRGBToLinear(c.r), SRGBToLinear(c.g), SRGBToLinear(c.b)})
+			}
+			array[x][y] = c
 		}
 	}
 
-	// fmt.Printf("%v\n", array[0])
 	return array
 }
 
-func main() {
-	listSpheres := []Sphere{}
-	listTriangles := []Triangle{}
+// defaultScene returns the built-in scene rendered when no scene file is given
+func defaultScene() Scene {
+	var scene Scene
+	scene.color = defaultConfig
 
 	cameraPosition := Tuple{1.4, 1, 2, 0}
 	cameraDirection := Tuple{-0.3, 0.7, 0, 0}
 	focusDistance := cameraDirection.Subtract(cameraPosition).Magnitude()
-	camera := getCamera(cameraPosition, cameraDirection, Tuple{0, 1, 0, 0}, 80, float64(hsize)/float64(vsize), 0.0, focusDistance)
+	scene.camera = getCamera(cameraPosition, cameraDirection, Tuple{0, 1, 0, 0}, 80, float64(hsize)/float64(vsize), 0.0, focusDistance)
 
 	file, err := os.Open("light.obj")
 	if err != nil {
 		log.Fatal(err)
 	}
-	loadOBJ(file, &listTriangles, Material{Emission, getConstant(Color{5, 5, 5}), 0, 1.45, 0, false}, false)
+	loadOBJ(file, &scene.triangles, Material{Emission, getConstant(Color{1, 1, 1}), 0, 1.45, 0, false, Emitter{5, 0, true, false}, Maps{}, nil, 1, 1}, false)
 
 	file, err = os.Open("bunny.obj")
 	if err != nil {
 		log.Fatal(err)
 	}
-	loadOBJ(file, &listTriangles, Material{Dielectric, getCheckerboard(Color{1, 0, 0}, Color{0.25, 0, 0}, 0.1, 0.1, 0.1), 0, 1.45, 0.5, false}, true)
-
-	log.Println("Building BVHs...")
-	bvh := getBVH(listTriangles, 10, 0)
-	log.Println("Built BVHs")
+	loadOBJ(file, &scene.triangles, Material{Dielectric, getCheckerboard(Color{1, 0, 0}, Color{0.25, 0, 0}, 0.1, 0.1, 0.1), 0, 1.45, 0.5, false, Emitter{}, Maps{}, nil, 2, 2}, true)
+	scene.files = []string{"light.obj", "bunny.obj"}
 
 	// BOTTOM
-	listSpheres = append(listSpheres, Sphere{
+	scene.spheres = append(scene.spheres, Sphere{
 		Tuple{0, -10000, 0, 0}, 10000,
-		Material{Lambertian, getConstant(Color{1, 1, 1}), 0, 1.45, 0, false},
+		Material{Lambertian, getConstant(Color{1, 1, 1}), 0, 1.45, 0, false, Emitter{}, Maps{}, nil, 3, 3},
 	})
 
-	world := HittableList{listSpheres, *bvh}
-
-	cpus := runtime.NumCPU()
-	runtime.GOMAXPROCS(cpus)
+	return scene
+}
 
-	buf := make([][]Color, cpus)
+// samplers maps names of sample sequences used on the command line
+var samplers = map[string]int{"independent": Independent, "stratified": Stratified, "halton": Halton, "sobol": Sobol, "bluenoise": BlueNoise}
 
-	for i := 0; i < cpus; i++ {
-		buf[i] = make([]Color, vsize*hsize)
-	}
+// tileOrders maps names of tile orders used on the command line
+var tileOrders = map[string]int{"scanline": ScanlineOrder, "spiral": SpiralOrder, "hilbert": HilbertOrder}
 
-	ch := make(chan int, cpus)
+// filters maps names of reconstruction filters used on the command line
+var filters = map[string]int{"box": BoxFilter, "tent": TentFilter, "gaussian": GaussianFilter, "mitchell": MitchellFilter, "blackman-harris": BlackmanHarrisFilter}
 
-	canvas := make([]Color, vsize*hsize)
+// formats maps names of image formats used on the command line
+var formats = map[string]int{"png": PNG, "ppm": PPM, "exr": EXR, "hdr": HDR, "pfm": PFM}
 
-	start := time.Now()
+// toneMaps maps names of tone mapping operators used on the command line
+var toneMaps = map[string]int{"clamp": ClampToneMap, "reinhard": ReinhardToneMap, "reinhard-extended": ExtendedReinhardToneMap, "hable": HableToneMap, "aces": ACESToneMap, "agx": AgXToneMap}
 
-	samplesCPU := samples / cpus
-	remainder := 0
+// exrCompressions maps names of compressions of EXR images used on the command line
+var exrCompressions = map[string]int{"none": NoCompression, "zip": ZIPCompression, "piz": PIZCompression}
 
-	if samples < cpus {
-		cpus = samples
-		samplesCPU = 1
-	} else if samples%cpus != 0 {
-		remainder = samples % cpus
+func main() {
+	samplesFlag := flag.Int("spp", samples, "number of samples of every pixel")
+	seed := flag.Uint64("seed", 0, "seed of random numbers, renders with the same settings and seed are identical")
+	sampler := flag.String("sampler", "sobol", "sequence of samples: independent, stratified, halton, sobol or bluenoise")
+	tileSize := flag.Int("tile", 32, "size of tiles in pixels")
+	order := flag.String("order", "spiral", "order of tiles: scanline, spiral or hilbert")
+	progressive := flag.Bool("progressive", false, "render passes over the whole image and write intermediate images")
+	writePasses := flag.Int("write-passes", 1, "in progressive mode write the image every number of passes, 0 to disable")
+	writeInterval := flag.Duration("write-interval", 0, "in progressive mode write the image after this much time, e.g. 10m")
+	adaptive := flag.Float64("adaptive", 0, "stop sampling pixels once relative error of their mean falls below this, e.g. 0.02, 0 to disable")
+	minSamples := flag.Int("min-spp", 32, "in adaptive mode number of samples of every pixel before its error is estimated")
+	heatmap := flag.Bool("heatmap", false, "write number of samples of every pixel into an image with _spp suffix")
+	checkpointFile := flag.String("checkpoint", "", "checkpoint file saved when stopped, when finished and periodically, the image name with .checkpoint by default")
+	checkpointInterval := flag.Duration("checkpoint-interval", 0, "save a checkpoint after this much time, e.g. 30m")
+	timeLimit := flag.Duration("time-limit", 0, "render passes until this much time is used by all frames and write the best image, samples are unlimited unless -spp is given")
+	filterName := flag.String("filter", "box", "reconstruction filter of pixels: box, tent, gaussian, mitchell or blackman-harris")
+	filterWidth := flag.Float64("filter-width", 0, "width of the filter in pixels, 0 for the default width of the filter")
+	filterSampling := flag.Bool("filter-sampling", false, "distribute samples of a pixel by the filter instead of splatting them to neighbouring pixels")
+	format := flag.String("format", "png", "format of images: png, ppm, exr, hdr or pfm")
+	compression := flag.String("exr-compression", "zip", "compression of EXR images: none, zip or piz")
+	exrFloat := flag.Bool("exr-float", false, "store 32 bit floats in EXR images instead of halves")
+	toneMapName := flag.String("tonemap", "clamp", "tone mapping of PNG and PPM images: clamp, reinhard, reinhard-extended, hable, aces or agx, "+
+		"optionally followed by values of outputs like aces,preview:clamp, -exposure, -white-balance and -white take them too, outputs are "+strings.Join(toneOutputs, ", "))
+	exposure := flag.String("exposure", "0", "exposure of PNG and PPM images in stops")
+	whiteBalance := flag.String("white-balance", "0", "color temperature in Kelvin of light that looks white in PNG and PPM images, 0 to disable")
+	white := flag.String("white", "4", "luminance mapped to white by extended Reinhard")
+	denoise := flag.Bool("denoise", false, "write a denoised image with _denoised suffix, albedo, normal and depth AOVs are rendered as its guides")
+	denoiseRadius := flag.Int("denoise-radius", 8, "radius in pixels of the window of the denoiser")
+	denoiseStrength := flag.Float64("denoise-strength", 1, "strength of the denoiser, larger values blur more")
+	post := flag.String("post", "", "comma separated chain of effects on linear images before tone mapping with optional amounts: bloom=0.1, vignette=0.5, aberration=2, sharpen=0.5, grain=0.05 and lut=file.cube")
+	serve := flag.String("serve", "", "serve previews, progress and controls of the render over HTTP at this address, e.g. localhost:8080")
+	aovList := flag.String("aov", "", "comma separated AOVs written as layers of EXR images or images with suffixes: "+strings.Join(aovNames[:], ", ")+" or all")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  go-pt [flags] [scene.json]\n  go-pt resume [flags] file.checkpoint [scene.json]\n  go-pt denoise [flags] image.exr...\n")
+		flag.PrintDefaults()
 	}
 
-	doneSamples := 0
-
-	log.Printf("Rendering %d triangles and %d spheres at %dx%d at %d samples on %d cores\n", len(listTriangles), len(listSpheres), hsize, vsize, samples, cpus)
-
-	for i := 0; i < cpus; i++ {
-		go func(i int) {
-			for s := 0; s < samplesCPU; s++ {
-				source := rand.NewSource(time.Now().UnixNano())
-				generator := rand.New(source)
-				sample := time.Now()
-				for y := vsize - 1; y >= 0; y-- {
-					for x := 0; x < hsize; x++ {
-						col := Color{0, 0, 0}
-						u := (float64(x) + RandFloat(*generator)) / float64(hsize)
-						v := (float64(y) + RandFloat(*generator)) / float64(vsize)
-						r := camera.getRay(u, v, *generator)
-
-						col = colorize(r, &world, 0, *generator)
+	// resume continues a render from a checkpoint, possibly to a higher number of samples
+	args := os.Args[1:]
+	resume := len(args) > 0 && args[0] == "resume"
+	// denoise filters EXR images saved with their guides
+	denoiseFiles := len(args) > 0 && args[0] == "denoise"
+	if resume || denoiseFiles {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
 
-						buf[i][y*hsize+x] = buf[i][y*hsize+x].Add(col)
-					}
+	settings := Settings{*samplesFlag, *seed, Sobol, *tileSize, ScanlineOrder, *adaptive, *minSamples, *progressive, *writePasses, *writeInterval, *checkpointInterval, *timeLimit, Filter{}, *filterSampling, nil}
+	if s, ok := samplers[*sampler]; ok {
+		settings.sampler = s
+	} else {
+		log.Fatalf("unknown sampler %q", *sampler)
+	}
+	if o, ok := tileOrders[*order]; ok {
+		settings.order = o
+	} else {
+		log.Fatalf("unknown tile order %q", *order)
+	}
+	if f, ok := filters[*filterName]; ok {
+		settings.filter = getFilter(f, *filterWidth)
+	} else {
+		log.Fatalf("unknown filter %q", *filterName)
+	}
+	extension, depth := PNG, 16
+	if e, ok := formats[*format]; ok {
+		extension = e
+	} else {
+		log.Fatalf("unknown image format %q", *format)
+	}
+	if c, ok := exrCompressions[*compression]; ok {
+		exrCompression = c
+	} else {
+		log.Fatalf("unknown EXR compression %q", *compression)
+	}
+	if extension == EXR && *exrFloat {
+		depth = 32
+	}
+	if *aovList == "all" {
+		for kind := range aovNames {
+			settings.aovs = append(settings.aovs, kind)
+		}
+	} else if *aovList != "" {
+		for _, name := range strings.Split(*aovList, ",") {
+			kind := -1
+			for k, n := range aovNames {
+				if n == strings.TrimSpace(name) {
+					kind = k
 				}
+			}
+			if kind < 0 {
+				log.Fatalf("unknown AOV %q", name)
+			}
+			settings.aovs = append(settings.aovs, kind)
+		}
+	}
+	tones, err := getToneMaps(*toneMapName, *exposure, *whiteBalance, *white)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tone := tones["beauty"]
+	chain, err := getEffects(*post)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *denoiseRadius < 1 || *denoiseStrength <= 0 {
+		log.Fatalf("denoise radius and strength must be positive")
+	}
+	denoiser := getDenoiser(*denoiseRadius, *denoiseStrength)
+	if denoiseFiles {
+		if flag.NArg() < 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		for _, path := range flag.Args() {
+			if err := denoiseEXR(path, denoiser, chain, extension, depth, defaultConfig, tones["denoised"]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	if settings.tileSize < 1 || settings.samples < 1 {
+		log.Fatalf("tile size and samples must be positive")
+	}
+	if settings.minSamples < 2 {
+		settings.minSamples = 2
+	}
+	if settings.timeLimit > 0 && !explicit["spp"] {
+		settings.samples = math.MaxInt32
+	}
 
-				doneSamples++
-				sampleTime := time.Since(sample)
-				fmt.Printf("\r%.2f%% (% 3d/% 3d) % 15s/sample, % 15s sample time, ETA: % 15s", float64(doneSamples)/float64(samples)*100, doneSamples, samples, sampleTime, sampleTime/(vsize*hsize), sampleTime*(time.Duration(samples)-time.Duration(doneSamples))/time.Duration(cpus))
+	scenePath := flag.Arg(0)
+	var checkpoint Checkpoint
+	if resume {
+		if flag.NArg() < 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		var err error
+		if checkpoint, err = loadCheckpoint(flag.Arg(0)); err != nil {
+			log.Fatal(err)
+		}
+		if checkpoint.Width != hsize || checkpoint.Height != vsize {
+			log.Fatalf("checkpoint is %dx%d, but images are %dx%d", checkpoint.Width, checkpoint.Height, hsize, vsize)
+		}
+		scenePath = checkpoint.Scene
+		if flag.NArg() > 1 {
+			scenePath = flag.Arg(1)
+		}
+		if *checkpointFile == "" {
+			*checkpointFile = flag.Arg(0)
+		}
+		// samples are accumulated the same way as the saved ones, settings which are not given are taken from the checkpoint
+		differs := map[string]bool{
+			"sampler":         settings.sampler != checkpoint.Sampler,
+			"tile":            settings.tileSize != checkpoint.TileSize,
+			"filter":          settings.filter.kind != checkpoint.Filter,
+			"filter-width":    settings.filter.radius != checkpoint.FilterRadius,
+			"filter-sampling": settings.filterSampling != checkpoint.FilterSampling,
+		}
+		for name, d := range differs {
+			if d && explicit[name] {
+				log.Fatalf("-%s differs from the checkpoint", name)
 			}
-			ch <- 1
-		}(i)
-	}
-
-	for i := 0; i < cpus; i++ {
-		<-ch
-	}
-	close(ch)
-
-	if remainder != 0 {
-		ch = make(chan int, cpus)
-		log.Printf("\nRendering additional %d samples...\n", remainder)
-		for i := 0; i < remainder; i++ {
-			go func(i int) {
-				source := rand.NewSource(time.Now().UnixNano())
-				generator := rand.New(source)
-				sample := time.Now()
-				for y := vsize - 1; y >= 0; y-- {
-					for x := 0; x < hsize; x++ {
-						col := Color{0, 0, 0}
-						u := (float64(x) + RandFloat(*generator)) / float64(hsize)
-						v := (float64(y) + RandFloat(*generator)) / float64(vsize)
-						r := camera.getRay(u, v, *generator)
-
-						col = colorize(r, &world, 0, *generator)
-
-						buf[i][y*hsize+x] = buf[i][y*hsize+x].Add(col)
-					}
+		}
+		settings.sampler, settings.tileSize, settings.filterSampling = checkpoint.Sampler, checkpoint.TileSize, checkpoint.FilterSampling
+		settings.filter = getFilter(checkpoint.Filter, 2*checkpoint.FilterRadius)
+		if !explicit["spp"] && settings.timeLimit == 0 {
+			settings.samples = checkpoint.Samples
+			if settings.samples == math.MaxInt32 {
+				log.Fatalf("checkpoint of a render with a time limit needs -spp or -time-limit")
+			}
+		}
+		// AOVs of the checkpoint are continued unless others are requested
+		if *aovList == "" {
+			for kind, name := range aovNames {
+				if _, ok := checkpoint.AOVs[name]; ok {
+					settings.aovs = append(settings.aovs, kind)
 				}
-
-				doneSamples++
-				sampleTime := time.Since(sample)
-				fmt.Printf("\r%.2f%% (% 3d/% 3d) % 15s/sample, % 15s sample time, ETA: % 15s", float64(doneSamples)/float64(samples)*100, doneSamples, samples, sampleTime, sampleTime/(vsize*hsize), sampleTime*(time.Duration(samples)-time.Duration(doneSamples))/time.Duration(cpus))
-				ch <- 1
-			}(i)
+			}
+		}
+	}
+	if *denoise {
+		// guides of the denoiser are written too, so that saved EXR images can be denoised again
+		for _, kind := range []int{AlbedoAOV, NormalAOV, DepthAOV} {
+			found := false
+			for _, k := range settings.aovs {
+				found = found || k == kind
+			}
+			if !found {
+				settings.aovs = append(settings.aovs, kind)
+			}
 		}
+	}
 
-		for i := 0; i < remainder; i++ {
-			<-ch
+	var scene Scene
+	if scenePath != "" {
+		scene, err = loadScene(scenePath)
+		if err != nil {
+			log.Fatal(err)
 		}
-		close(ch)
+	} else {
+		scene = defaultScene()
+	}
+	hash, err := sceneHash(scene.files)
+	if err != nil {
+		log.Fatal(err)
 	}
+	if resume && hash != checkpoint.Hash {
+		log.Fatalf("scene %q or its files do not match the checkpoint", scenePath)
+	}
+	config := scene.color
+	camera := scene.camera
+	listSpheres := scene.spheres
+	listTriangles := scene.triangles
 
-	elapsed := time.Since(start)
-	log.Printf("\nRendering took %s\n", elapsed)
-	for i := 0; i < cpus; i++ {
-		for y := 0; y < vsize; y++ {
-			for x := 0; x < hsize; x++ {
-				canvas[y*hsize+x] = canvas[y*hsize+x].Add(buf[i][y*hsize+x])
-			}
+	log.Println("Building BVHs...")
+	bvh := getBVH(listTriangles, 10, 0)
+	instances := getInstanceBVH(scene.instances)
+	log.Println("Built BVHs")
+
+	world := HittableList{listSpheres, *bvh, instances}
+
+	if scene.autofocus != nil {
+		if focused, ok := autofocus(camera, &world, scene.autofocus[0], scene.autofocus[1]); ok {
+			camera = focused
+		} else {
+			log.Printf("Nothing to focus on at %v, keeping focus distance\n", scene.autofocus)
 		}
 	}
 
-	for y := 0; y < vsize; y++ {
-		for x := 0; x < hsize; x++ {
-			canvas[y*hsize+x] = canvas[y*hsize+x].DivScalar(float64(samples))
+	log.Printf("Rendering %d triangles and %d spheres at %dx%d at %d samples on %d cores\n", len(listTriangles), len(listSpheres), hsize, vsize, settings.samples, runtime.NumCPU())
+
+	renderer := &Renderer{camera, &world, scene.shutter, config, settings, nil, nil, 0, 0, time.Time{}, sync.Mutex{}, nil, nil}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Stopping, press Ctrl+C again to quit without saving a checkpoint")
+		renderer.stop()
+		<-signals
+		os.Exit(1)
+	}()
+	var server *Server
+	if *serve != "" {
+		server = getServer(renderer, config, tones["preview"], chain)
+		if err := server.listen(*serve); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	fmt.Printf("Saving...\n")
-	// filename := fmt.Sprintf("frame_%d.ppm", 0)
-	filename := fmt.Sprintf("frame_%d", time.Now().UnixNano()/1e6)
+	// objects and their BVHs stay the same for all frames, only the time of rays changes
+	first, last, fps := 0, 0, 1.0
+	if animation := scene.animation; animation != nil {
+		first, last, fps = animation.start, animation.end, animation.fps
+	}
+	if resume {
+		first = checkpoint.Frame
+	}
+	started := time.Now()
+	for frame := first; frame <= last; frame++ {
+		// filename := fmt.Sprintf("frame_%d.ppm", 0)
+		filename := fmt.Sprintf("frame_%d", time.Now().UnixNano()/1e6)
+		if scene.animation != nil {
+			log.Printf("Rendering frame %d of %d-%d\n", frame, first, last)
+			filename = fmt.Sprintf("frame_%04d", frame)
+		}
+		film := getFilm(hsize, vsize, settings.tileSize, settings.order, settings.margin(), settings.aovs)
+		// every frame of an animation gets different noise
+		film.seed = settings.seed ^ pcg(uint64(frame))
+		if resume && frame == checkpoint.Frame {
+			filename = checkpoint.Output
+			if film, err = checkpoint.film(settings.order, settings.margin(), settings.aovs); err != nil {
+				log.Fatal(err)
+			}
+		}
 
-	SaveImage(canvas, hsize, vsize, 255, filename, PNG, 16)
+		checkpointPath := *checkpointFile
+		if checkpointPath == "" {
+			checkpointPath = filename + ".checkpoint"
+		}
+		state := Checkpoint{scenePath, hash, filename, frame, settings.samples, settings.sampler, settings.filter.kind, settings.filter.radius, settings.filterSampling, 0, 0, 0, 0, nil, nil, nil, nil, nil, nil}
+		seed := film.seed
+		renderer.output = func(canvas []Color) {
+			SaveImage(applyEffects(canvas, hsize, vsize, chain, seed, config), hsize, vsize, 255, filename, extension, depth, config, tone)
+		}
+		// AOVs are written only with the final image, post effects are applied only to the beauty image after denoising
+		save := func(film *Film) {
+			canvas := film.resolve()
+			if len(settings.aovs) > 0 {
+				aovs := film.resolveAOVs()
+				SaveAOVs(applyEffects(canvas, hsize, vsize, chain, seed, config), aovs, settings.aovs, hsize, vsize, filename, extension, depth, config, tone)
+				if *denoise {
+					albedo, normal, distance := guides(aovs, settings.aovs)
+					denoised := denoiser.denoise(canvas, albedo, normal, distance, hsize, vsize)
+					SaveImage(applyEffects(denoised, hsize, vsize, chain, seed, config), hsize, vsize, 255, filename+"_denoised", extension, depth, config, tones["denoised"])
+				}
+			} else {
+				SaveImage(applyEffects(canvas, hsize, vsize, chain, seed, config), hsize, vsize, 255, filename, extension, depth, config, tone)
+			}
+		}
+		if server != nil {
+			server.setFrame(frame, func() string {
+				name := filename + "_snapshot"
+				SaveImage(applyEffects(film.resolve(), hsize, vsize, chain, seed, config), hsize, vsize, 255, name, extension, depth, config, tone)
+				return name
+			})
+		}
+		renderer.checkpoint = func(film *Film) {
+			if err := saveCheckpoint(checkpointPath, state, film); err != nil {
+				log.Printf("Saving checkpoint failed: %v\n", err)
+			}
+		}
+
+		if settings.timeLimit > 0 {
+			// the time left is split evenly between the remaining frames
+			left := settings.timeLimit - time.Since(started)
+			renderer.deadline = time.Now().Add(left / time.Duration(last-frame+1))
+		}
+		if !renderer.render(film, float64(frame)/fps) {
+			renderer.checkpoint(film)
+			save(film)
+			log.Printf("Saved checkpoint, continue with: go-pt resume %s\n", checkpointPath)
+			return
+		}
+
+		fmt.Printf("Saving...\n")
+		save(film)
+		if *heatmap {
+			// the heatmap is not a picture, so it is written without color conversions
+			SaveImage(film.heatmap(), hsize, vsize, 255, filename+"_spp", PNG, 8, dataConfig, ToneMap{})
+		}
+		// a finished checkpoint allows adding samples later
+		if *checkpointFile != "" || settings.checkpointInterval > 0 {
+			renderer.checkpoint(film)
+		}
+	}
 }
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"math/rand"
+	"math"
 )
 
 const (
@@ -14,23 +14,190 @@ const (
 
 type Material struct {
 	material    int
-	albedo      Texture
+	albedo      Node
 	roughness   float64
 	ior         float64
 	specularity float64
 	checkered   bool
+	emitter     Emitter
+	maps        Maps
+	animation   []MaterialKey
+	id          int // index of the material in the scene starting at 1, used by ID masks
+	object      int // index of the object using this copy of the material starting at 1
 }
 
-func (m Material) Scatter(r Ray, rec HitRecord, attenuation *Color, scattered *Ray, generator rand.Rand) bool {
+// MaterialKey holds animated parameters of a material at a point in time
+type MaterialKey struct {
+	time                                               float64
+	roughness, ior, specularity, strength, temperature float64
+	interpolation                                      int
+}
+
+// at returns the material with animated parameters evaluated at given time
+func (m Material) at(time float64) Material {
+	if m.animation == nil {
+		return m
+	}
+	keys := m.animation
+	indices, weights := keyWeights(len(keys), func(i int) (float64, int) {
+		return keys[i].time, keys[i].interpolation
+	}, time)
+	m.roughness, m.ior, m.specularity, m.emitter.strength, m.emitter.temperature = 0, 0, 0, 0, 0
+	for j, i := range indices {
+		w := weights[j]
+		m.roughness += keys[i].roughness * w
+		m.ior += keys[i].ior * w
+		m.specularity += keys[i].specularity * w
+		m.emitter.strength += keys[i].strength * w
+		m.emitter.temperature += keys[i].temperature * w
+	}
+	return m
+}
+
+// Maps holds optional texture graphs driving material parameters instead of constant values
+type Maps struct {
+	roughness, ior, specularity Node
+	emission                    Node // multiplies emitted color
+	normal                      Node // tangent space normal map
+	bump                        Node // height map
+	bumpStrength                float64
+}
+
+// bumpDelta is the step in texture coordinates used to differentiate bump maps
+const bumpDelta = 0.001
+
+// tangentFrame returns unit tangent and bitangent perpendicular to the normal at hit point
+func tangentFrame(rec HitRecord) (Tuple, Tuple) {
+	n := rec.normal
+	tangent := rec.tangent.Subtract(n.MulScalar(n.Dot(rec.tangent)))
+	if tangent.Magnitude() < Epsilon {
+		// no texture coordinates, any tangent will do
+		axis := Tuple{1, 0, 0, 0}
+		if math.Abs(n.x) > 0.9 {
+			axis = Tuple{0, 1, 0, 0}
+		}
+		tangent = axis.Subtract(n.MulScalar(n.Dot(axis)))
+	}
+	tangent = tangent.Normalize()
+	handedness := rec.handedness
+	if handedness == 0 {
+		handedness = 1
+	}
+	return tangent, n.Cross(tangent).MulScalar(handedness)
+}
+
+// perturbNormal applies normal and bump maps of the material to the shading normal
+func (m Material) perturbNormal(rec *HitRecord) {
+	if m.maps.normal == nil && m.maps.bump == nil {
+		return
+	}
+	rec.normal = rec.normal.Normalize()
+	tangent, bitangent := tangentFrame(*rec)
+
+	if m.maps.normal != nil {
+		c := m.maps.normal.color(*rec)
+		rec.normal = tangent.MulScalar(2*c.r - 1).Add(bitangent.MulScalar(2*c.g - 1)).Add(rec.normal.MulScalar(2*c.b - 1)).Normalize()
+		tangent, bitangent = tangentFrame(*rec)
+	}
+
+	if m.maps.bump != nil {
+		// move the point along with texture coordinates so solid textures get differentiated too
+		step := 0.0
+		if rec.uvScale > 0 {
+			step = bumpDelta / rec.uvScale
+		}
+		du := *rec
+		du.u += bumpDelta
+		du.p = du.p.Add(tangent.MulScalar(step))
+		dv := *rec
+		dv.v += bumpDelta
+		dv.p = dv.p.Subtract(bitangent.MulScalar(step))
+
+		h := scalar(m.maps.bump, *rec)
+		dhdu := (scalar(m.maps.bump, du) - h) / bumpDelta
+		dhdv := (scalar(m.maps.bump, dv) - h) / bumpDelta
+		// bitangent points up the image, against increasing v
+		offset := tangent.MulScalar(dhdu).Subtract(bitangent.MulScalar(dhdv)).MulScalar(m.maps.bumpStrength)
+		rec.normal = rec.normal.Subtract(offset).Normalize()
+	}
+}
+
+// Emitter holds the properties of an Emission material
+type Emitter struct {
+	strength    float64 // multiplier applied to the emission color
+	temperature float64 // blackbody temperature in Kelvin, 0 disables it
+	twoSided    bool    // emit from both sides of the surface
+	normalize   bool    // treat strength as total power and divide it by the area
+}
+
+// Emitted returns the light emitted towards the origin of the ray in the working space of config
+func (m Material) Emitted(r Ray, rec HitRecord, config ColorConfig) Color {
+	if m.material != Emission {
+		return Color{0, 0, 0}
+	}
+	m = m.at(r.time)
+	if !m.emitter.twoSided && r.direction.Dot(rec.normal) > 0 {
+		return Color{0, 0, 0}
+	}
+	emitted := m.albedo.color(rec).MulScalar(m.emitter.strength)
+	if m.maps.emission != nil {
+		emitted = emitted.Mul(m.maps.emission.color(rec))
+	}
+	if m.emitter.temperature > 0 {
+		emitted = emitted.Mul(config.fromLinearSRGB(Blackbody(m.emitter.temperature)))
+	}
+	return emitted
+}
+
+// normalizeEmission converts power of the emitter into radiance of a surface with given area
+func (m Material) normalizeEmission(area float64) Material {
+	if m.material != Emission || !m.emitter.normalize || area <= 0 {
+		return m
+	}
+	if m.emitter.twoSided {
+		area *= 2
+	}
+	m.emitter.strength /= area * math.Pi
+	if m.animation != nil {
+		keys := make([]MaterialKey, len(m.animation))
+		copy(keys, m.animation)
+		for i := range keys {
+			keys[i].strength /= area * math.Pi
+		}
+		m.animation = keys
+	}
+	return m
+}
+
+// parameters returns roughness, index of refraction and specularity at hit point
+func (m Material) parameters(rec HitRecord) (float64, float64, float64) {
+	roughness, ior, specularity := m.roughness, m.ior, m.specularity
+	if m.maps.roughness != nil {
+		roughness = scalar(m.maps.roughness, rec)
+	}
+	if m.maps.ior != nil {
+		ior = scalar(m.maps.ior, rec)
+	}
+	if m.maps.specularity != nil {
+		specularity = scalar(m.maps.specularity, rec)
+	}
+	return roughness, ior, specularity
+}
+
+// Scatter returns false when the ray is absorbed, specular tells if the ray was reflected or refracted rather than diffused
+func (m Material) Scatter(r Ray, rec HitRecord, attenuation *Color, scattered *Ray, specular *bool, generator *Sampler) bool {
+	m = m.at(r.time)
+	roughness, ior, specularity := m.parameters(rec)
+	*specular = m.material == Metal || m.material == Dielectric
 	if m.material == Lambertian {
 		target := rec.p.Add(rec.normal).Add(RandInUnitSphere(generator))
-		*scattered = Ray{rec.p, target.Subtract(rec.p)}
-		*attenuation = m.albedo.color(rec.u, rec.v, rec.p)
+		*scattered = Ray{rec.p, target.Subtract(rec.p), rec.footprint, r.spread, r.time}
+		*attenuation = m.albedo.color(rec)
 		return true
 	} else if m.material == Metal {
 		reflected := (r.direction.Normalize()).Reflection(rec.normal)
-		*scattered = Ray{rec.p, reflected.Add(RandInUnitSphere(generator).MulScalar(m.roughness))}
-		*attenuation = m.albedo.color(rec.u, rec.v, rec.p)
+		*scattered = Ray{rec.p, reflected.Add(RandInUnitSphere(generator).MulScalar(roughness)), rec.footprint, r.spread, r.time}
+		*attenuation = m.albedo.color(rec)
 		return (scattered.direction.Dot(rec.normal) > 0)
 	} else if m.material == Dielectric {
 		var outwardNormal Tuple
@@ -40,21 +207,21 @@ func (m Material) Scatter(r Ray, rec HitRecord, attenuation *Color, scattered *R
 		var reflectProbability float64
 		var cosine float64
 
-		*attenuation = m.albedo.color(rec.u, rec.v, rec.p)
+		*attenuation = m.albedo.color(rec)
 		reflected := r.direction.Reflection(rec.normal)
 
 		if r.direction.Dot(rec.normal) > 0 {
 			outwardNormal = rec.normal.MulScalar(-1)
-			niOverNt = m.ior
-			cosine = m.ior * r.direction.Dot(rec.normal) / r.direction.Magnitude()
+			niOverNt = ior
+			cosine = ior * r.direction.Dot(rec.normal) / r.direction.Magnitude()
 		} else {
 			outwardNormal = rec.normal
-			niOverNt = 1.0 / m.ior
+			niOverNt = 1.0 / ior
 			cosine = -(r.direction.Dot(rec.normal) / r.direction.Magnitude())
 		}
 
 		if r.direction.Refraction(outwardNormal, niOverNt, &refracted) {
-			reflectProbability = Schlick(cosine, m.ior) + m.specularity/2
+			reflectProbability = Schlick(cosine, ior) + specularity/2
 			if reflectProbability > 1.0 {
 				reflectProbability = 1.0
 			}
@@ -63,10 +230,10 @@ func (m Material) Scatter(r Ray, rec HitRecord, attenuation *Color, scattered *R
 		}
 
 		if RandFloat(generator) < reflectProbability {
-			*scattered = Ray{rec.p, reflected.Add(RandInUnitSphere(generator).MulScalar(m.roughness))}
+			*scattered = Ray{rec.p, reflected.Add(RandInUnitSphere(generator).MulScalar(roughness)), rec.footprint, r.spread, r.time}
 			*attenuation = Color{reflectProbability, reflectProbability, reflectProbability}
 		} else {
-			*scattered = Ray{rec.p, refracted.Add(RandInUnitSphere(generator).MulScalar(m.roughness))}
+			*scattered = Ray{rec.p, refracted.Add(RandInUnitSphere(generator).MulScalar(roughness)), rec.footprint, r.spread, r.time}
 		}
 
 		return true
@@ -80,21 +247,21 @@ func (m Material) Scatter(r Ray, rec HitRecord, attenuation *Color, scattered *R
 		var reflectProbability float64
 		var cosine float64
 
-		*attenuation = m.albedo.color(rec.u, rec.v, rec.p)
+		*attenuation = m.albedo.color(rec)
 		reflected := r.direction.Reflection(rec.normal)
 
 		if r.direction.Dot(rec.normal) > 0 {
 			outwardNormal = rec.normal.MulScalar(-1)
-			niOverNt = m.ior
+			niOverNt = ior
 			cosine = 1 * r.direction.Dot(rec.normal) / r.direction.Magnitude()
 		} else {
 			outwardNormal = rec.normal
-			niOverNt = 1.0 / m.ior
+			niOverNt = 1.0 / ior
 			cosine = -(r.direction.Dot(rec.normal) / r.direction.Magnitude())
 		}
 
 		if r.direction.Refraction(outwardNormal, niOverNt, &refracted) {
-			reflectProbability = Schlick(cosine, m.ior) + m.specularity/2
+			reflectProbability = Schlick(cosine, ior) + specularity/2
 			if reflectProbability > 1.0 {
 				reflectProbability = 1.0
 			}
@@ -103,11 +270,12 @@ func (m Material) Scatter(r Ray, rec HitRecord, attenuation *Color, scattered *R
 		}
 
 		if RandFloat(generator) < reflectProbability {
-			*scattered = Ray{rec.p, reflected.Add(RandInUnitSphere(generator).MulScalar(m.roughness))}
+			*scattered = Ray{rec.p, reflected.Add(RandInUnitSphere(generator).MulScalar(roughness)), rec.footprint, r.spread, r.time}
 			*attenuation = Color{reflectProbability, reflectProbability, reflectProbability}
+			*specular = true
 		} else {
 			target := rec.p.Add(rec.normal).Add(RandInUnitSphere(generator))
-			*scattered = Ray{rec.p, target.Subtract(rec.p)}
+			*scattered = Ray{rec.p, target.Subtract(rec.p), rec.footprint, r.spread, r.time}
 		}
 
 		return true
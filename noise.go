@@ -0,0 +1,203 @@
+package main
+
+import (
+	"math"
+)
+
+// permutation table from Ken Perlin's reference implementation
+var permutation = [256]int{
+	151, 160, 137, 91, 90, 15, 131, 13, 201, 95, 96, 53, 194, 233, 7, 225,
+	140, 36, 103, 30, 69, 142, 8, 99, 37, 240, 21, 10, 23, 190, 6, 148,
+	247, 120, 234, 75, 0, 26, 197, 62, 94, 252, 219, 203, 117, 35, 11, 32,
+	57, 177, 33, 88, 237, 149, 56, 87, 174, 20, 125, 136, 171, 168, 68, 175,
+	74, 165, 71, 134, 139, 48, 27, 166, 77, 146, 158, 231, 83, 111, 229, 122,
+	60, 211, 133, 230, 220, 105, 92, 41, 55, 46, 245, 40, 244, 102, 143, 54,
+	65, 25, 63, 161, 1, 216, 80, 73, 209, 76, 132, 187, 208, 89, 18, 169,
+	200, 196, 135, 130, 116, 188, 159, 86, 164, 100, 109, 198, 173, 186, 3, 64,
+	52, 217, 226, 250, 124, 123, 5, 202, 38, 147, 118, 126, 255, 82, 85, 212,
+	207, 206, 59, 227, 47, 16, 58, 17, 182, 189, 28, 42, 223, 183, 170, 213,
+	119, 248, 152, 2, 44, 154, 163, 70, 221, 153, 101, 155, 167, 43, 172, 9,
+	129, 22, 39, 253, 19, 98, 108, 110, 79, 113, 224, 232, 178, 185, 112, 104,
+	218, 246, 97, 228, 251, 34, 242, 193, 238, 210, 144, 12, 191, 179, 162, 241,
+	81, 51, 145, 235, 249, 14, 239, 107, 49, 192, 214, 31, 181, 199, 106, 157,
+	184, 84, 204, 176, 115, 121, 50, 45, 127, 4, 150, 254, 138, 236, 205, 93,
+	222, 114, 67, 29, 24, 72, 243, 141, 128, 195, 78, 66, 215, 61, 156, 180,
+}
+
+func perm(i int) int {
+	return permutation[i&255]
+}
+
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+func lerp(a, b, t float64) float64 {
+	return a + t*(b-a)
+}
+
+func grad(hash int, x, y, z float64) float64 {
+	h := hash & 15
+	u := y
+	if h < 8 {
+		u = x
+	}
+	v := z
+	if h < 4 {
+		v = y
+	} else if h == 12 || h == 14 {
+		v = x
+	}
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+	return u + v
+}
+
+// Perlin returns improved Perlin noise in range [-1, 1]
+func Perlin(p Tuple) float64 {
+	fx, fy, fz := math.Floor(p.x), math.Floor(p.y), math.Floor(p.z)
+	X, Y, Z := int(fx)&255, int(fy)&255, int(fz)&255
+	x, y, z := p.x-fx, p.y-fy, p.z-fz
+	u, v, w := fade(x), fade(y), fade(z)
+
+	A := perm(X) + Y
+	AA := perm(A) + Z
+	AB := perm(A+1) + Z
+	B := perm(X+1) + Y
+	BA := perm(B) + Z
+	BB := perm(B+1) + Z
+
+	return lerp(
+		lerp(
+			lerp(grad(perm(AA), x, y, z), grad(perm(BA), x-1, y, z), u),
+			lerp(grad(perm(AB), x, y-1, z), grad(perm(BB), x-1, y-1, z), u),
+			v),
+		lerp(
+			lerp(grad(perm(AA+1), x, y, z-1), grad(perm(BA+1), x-1, y, z-1), u),
+			lerp(grad(perm(AB+1), x, y-1, z-1), grad(perm(BB+1), x-1, y-1, z-1), u),
+			v),
+		w)
+}
+
+var simplexGradients = [12][3]float64{
+	{1, 1, 0}, {-1, 1, 0}, {1, -1, 0}, {-1, -1, 0},
+	{1, 0, 1}, {-1, 0, 1}, {1, 0, -1}, {-1, 0, -1},
+	{0, 1, 1}, {0, -1, 1}, {0, 1, -1}, {0, -1, -1},
+}
+
+// Simplex returns 3D simplex noise in range [-1, 1]
+func Simplex(p Tuple) float64 {
+	const f3 = 1.0 / 3.0
+	const g3 = 1.0 / 6.0
+
+	s := (p.x + p.y + p.z) * f3
+	i, j, k := math.Floor(p.x+s), math.Floor(p.y+s), math.Floor(p.z+s)
+	t := (i + j + k) * g3
+	x0, y0, z0 := p.x-(i-t), p.y-(j-t), p.z-(k-t)
+
+	// find which of the six simplices the point is in
+	var i1, j1, k1, i2, j2, k2 int
+	if x0 >= y0 {
+		if y0 >= z0 {
+			i1, j1, k1, i2, j2, k2 = 1, 0, 0, 1, 1, 0
+		} else if x0 >= z0 {
+			i1, j1, k1, i2, j2, k2 = 1, 0, 0, 1, 0, 1
+		} else {
+			i1, j1, k1, i2, j2, k2 = 0, 0, 1, 1, 0, 1
+		}
+	} else {
+		if y0 < z0 {
+			i1, j1, k1, i2, j2, k2 = 0, 0, 1, 0, 1, 1
+		} else if x0 < z0 {
+			i1, j1, k1, i2, j2, k2 = 0, 1, 0, 0, 1, 1
+		} else {
+			i1, j1, k1, i2, j2, k2 = 0, 1, 0, 1, 1, 0
+		}
+	}
+
+	corners := [4][3]float64{
+		{x0, y0, z0},
+		{x0 - float64(i1) + g3, y0 - float64(j1) + g3, z0 - float64(k1) + g3},
+		{x0 - float64(i2) + 2*g3, y0 - float64(j2) + 2*g3, z0 - float64(k2) + 2*g3},
+		{x0 - 1 + 3*g3, y0 - 1 + 3*g3, z0 - 1 + 3*g3},
+	}
+	offsets := [4][3]int{{0, 0, 0}, {i1, j1, k1}, {i2, j2, k2}, {1, 1, 1}}
+
+	ii, jj, kk := int(i)&255, int(j)&255, int(k)&255
+	n := 0.0
+	for c := 0; c < 4; c++ {
+		x, y, z := corners[c][0], corners[c][1], corners[c][2]
+		t := 0.6 - x*x - y*y - z*z
+		if t < 0 {
+			continue
+		}
+		g := simplexGradients[perm(ii+offsets[c][0]+perm(jj+offsets[c][1]+perm(kk+offsets[c][2])))%12]
+		t *= t
+		n += t * t * (g[0]*x + g[1]*y + g[2]*z)
+	}
+	return 32 * n
+}
+
+// FBM returns fractal Brownian motion built from octaves of Perlin noise in range [-1, 1]
+func FBM(p Tuple, octaves int, lacunarity, gain float64) float64 {
+	sum, amplitude, total := 0.0, 1.0, 0.0
+	for i := 0; i < octaves; i++ {
+		sum += amplitude * Perlin(p)
+		total += amplitude
+		amplitude *= gain
+		p = p.MulScalar(lacunarity)
+	}
+	if total == 0 {
+		return 0
+	}
+	return sum / total
+}
+
+// Turbulence returns sum of absolute values of Perlin noise octaves in range [0, 1]
+func Turbulence(p Tuple, octaves int, lacunarity, gain float64) float64 {
+	sum, amplitude, total := 0.0, 1.0, 0.0
+	for i := 0; i < octaves; i++ {
+		sum += amplitude * math.Abs(Perlin(p))
+		total += amplitude
+		amplitude *= gain
+		p = p.MulScalar(lacunarity)
+	}
+	if total == 0 {
+		return 0
+	}
+	return sum / total
+}
+
+// cellPoint returns feature point of a Worley noise cell
+func cellPoint(x, y, z int) Tuple {
+	h := perm(x + perm(y+perm(z)))
+	return Tuple{
+		float64(x) + float64(perm(h))/255,
+		float64(y) + float64(perm(h+1))/255,
+		float64(z) + float64(perm(h+2))/255,
+		0,
+	}
+}
+
+// Worley returns distance to the closest and second closest feature point
+func Worley(p Tuple) (float64, float64) {
+	cx, cy, cz := int(math.Floor(p.x)), int(math.Floor(p.y)), int(math.Floor(p.z))
+	f1, f2 := math.MaxFloat64, math.MaxFloat64
+	for x := cx - 1; x <= cx+1; x++ {
+		for y := cy - 1; y <= cy+1; y++ {
+			for z := cz - 1; z <= cz+1; z++ {
+				d := cellPoint(x, y, z).Subtract(p).Magnitude()
+				if d < f1 {
+					f1, f2 = d, f1
+				} else if d < f2 {
+					f2 = d
+				}
+			}
+		}
+	}
+	return f1, f2
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// post effects applied to linear images before tone mapping
+const (
+	BloomEffect = iota
+	VignetteEffect
+	AberrationEffect
+	SharpenEffect
+	GrainEffect
+	LUTEffect
+)
+
+// effects maps names of post effects used on the command line
+var effects = map[string]int{"bloom": BloomEffect, "vignette": VignetteEffect, "aberration": AberrationEffect, "sharpen": SharpenEffect, "grain": GrainEffect, "lut": LUTEffect}
+
+// effectAmounts are amounts of effects given without a value
+var effectAmounts = map[int]float64{BloomEffect: 0.1, VignetteEffect: 0.5, AberrationEffect: 2, SharpenEffect: 0.5, GrainEffect: 0.05}
+
+// Effect is a post effect with its amount, which is the strength of bloom, the tangent of the angle of view at the corner for vignette,
+// the shift of red and blue in pixels at the corner for aberration, the weight of the unsharp mask and the deviation of film grain
+type Effect struct {
+	kind   int
+	amount float64
+	lut    *LUT
+}
+
+// LUT is a 1D or 3D lookup table of a .cube file, red changes the fastest in the table
+type LUT struct {
+	size                 int
+	cube                 bool
+	domainMin, domainMax Color
+	table                []Color
+}
+
+// getEffects parses a comma separated chain of effects with optional amounts like bloom=0.2, the value of lut is a .cube file
+func getEffects(chain string) ([]Effect, error) {
+	var list []Effect
+	if chain == "" {
+		return list, nil
+	}
+	for _, item := range strings.Split(chain, ",") {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(item), "=")
+		kind, ok := effects[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown post effect %q", name)
+		}
+		effect := Effect{kind, effectAmounts[kind], nil}
+		if kind == LUTEffect {
+			if !hasValue {
+				return nil, errors.New("lut needs a .cube file, e.g. lut=grade.cube")
+			}
+			lut, err := loadCube(value)
+			if err != nil {
+				return nil, err
+			}
+			effect.lut = lut
+		} else if hasValue {
+			amount, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("post effect %s: %v", name, err)
+			}
+			effect.amount = amount
+		}
+		list = append(list, effect)
+	}
+	return list, nil
+}
+
+// loadCube reads a lookup table in the .cube format of Adobe and Resolve
+func loadCube(path string) (*LUT, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lut := &LUT{0, false, Color{0, 0, 0}, Color{1, 1, 1}, nil}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || fields[0] == "TITLE" {
+			continue
+		}
+		values := make([]float64, len(fields)-1)
+		for i := range values {
+			if values[i], err = strconv.ParseFloat(fields[i+1], 64); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		}
+		if fields[0] == "LUT_1D_SIZE" || fields[0] == "LUT_3D_SIZE" {
+			if len(values) != 1 || values[0] < 2 || values[0] > 256 {
+				return nil, fmt.Errorf("%s: invalid size", path)
+			}
+			lut.size, lut.cube = int(values[0]), fields[0] == "LUT_3D_SIZE"
+		} else if fields[0] == "DOMAIN_MIN" && len(values) == 3 {
+			lut.domainMin = Color{values[0], values[1], values[2]}
+		} else if fields[0] == "DOMAIN_MAX" && len(values) == 3 {
+			lut.domainMax = Color{values[0], values[1], values[2]}
+		} else {
+			v, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil || len(values) != 2 {
+				return nil, fmt.Errorf("%s: invalid line %q", path, scanner.Text())
+			}
+			lut.table = append(lut.table, Color{v, values[0], values[1]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	n := lut.size
+	if lut.cube {
+		n = n * n * n
+	}
+	if n == 0 || len(lut.table) != n {
+		return nil, fmt.Errorf("%s: expected %d entries, found %d", path, n, len(lut.table))
+	}
+	if lut.domainMax.r <= lut.domainMin.r || lut.domainMax.g <= lut.domainMin.g || lut.domainMax.b <= lut.domainMin.b {
+		return nil, fmt.Errorf("%s: domain is empty", path)
+	}
+	return lut, nil
+}
+
+// lookup returns color of the table interpolated linearly, colors outside of the domain are clamped
+func (lut *LUT) lookup(c Color) Color {
+	scale := float64(lut.size - 1)
+	position := func(v, low, high float64) (int, float64) {
+		v = math.Max(0, math.Min(1, (v-low)/(high-low))) * scale
+		i := int(math.Min(v, scale-1))
+		return i, v - float64(i)
+	}
+	r, fr := position(c.r, lut.domainMin.r, lut.domainMax.r)
+	g, fg := position(c.g, lut.domainMin.g, lut.domainMax.g)
+	b, fb := position(c.b, lut.domainMin.b, lut.domainMax.b)
+	if !lut.cube {
+		mix := func(i int, f float64) Color {
+			return lut.table[i].MulScalar(1 - f).Add(lut.table[i+1].MulScalar(f))
+		}
+		return Color{mix(r, fr).r, mix(g, fg).g, mix(b, fb).b}
+	}
+	at := func(i, j, k int) Color {
+		return lut.table[(k*lut.size+j)*lut.size+i]
+	}
+	out := Color{0, 0, 0}
+	for corner := 0; corner < 8; corner++ {
+		i, j, k := corner&1, corner>>1&1, corner>>2&1
+		w := (float64(1-i)*(1-fr) + float64(i)*fr) * (float64(1-j)*(1-fg) + float64(j)*fg) * (float64(1-k)*(1-fb) + float64(k)*fb)
+		out = out.Add(at(r+i, g+j, b+k).MulScalar(w))
+	}
+	return out
+}
+
+// applyEffects runs the chain of effects on a copy of canvas in the working space of config, seed decides the film grain
+func applyEffects(canvas []Color, width, height int, chain []Effect, seed uint64, config ColorConfig) []Color {
+	if len(chain) == 0 {
+		return canvas
+	}
+	out := append([]Color(nil), canvas...)
+	cx, cy := float64(width)/2, float64(height)/2
+	corner := math.Hypot(cx, cy)
+	for _, e := range chain {
+		if e.kind == BloomEffect {
+			// light above 1 spreads with glare of three widths, the narrow one the strongest
+			bright := make([]Color, len(out))
+			for i, c := range out {
+				if l := config.luminance(c); l > 1 {
+					bright[i] = c.MulScalar((l - 1) / l)
+				}
+			}
+			bloom := make([]Color, len(out))
+			for _, w := range [][2]float64{{0.005, 0.5}, {0.02, 0.3}, {0.06, 0.2}} {
+				blurred := gaussianBlur(bright, width, height, w[0]*corner)
+				for i := range bloom {
+					bloom[i] = bloom[i].Add(blurred[i].MulScalar(w[1]))
+				}
+			}
+			for i := range out {
+				out[i] = out[i].Add(bloom[i].MulScalar(e.amount))
+			}
+		} else if e.kind == VignetteEffect {
+			// natural vignetting falls off with the fourth power of the cosine of the angle from the axis
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					t := e.amount * math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) / corner
+					out[y*width+x] = out[y*width+x].MulScalar(1 / ((1 + t*t) * (1 + t*t)))
+				}
+			}
+		} else if e.kind == AberrationEffect {
+			// lateral aberration magnifies red and blue differently, green stays in place
+			source := append([]Color(nil), out...)
+			scale := e.amount / corner
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+					red := bilinear(source, width, height, cx+dx*(1+scale)-0.5, cy+dy*(1+scale)-0.5)
+					blue := bilinear(source, width, height, cx+dx*(1-scale)-0.5, cy+dy*(1-scale)-0.5)
+					out[y*width+x].r, out[y*width+x].b = red.r, blue.b
+				}
+			}
+		} else if e.kind == SharpenEffect {
+			// unsharp mask adds the difference from the blurred image
+			blurred := gaussianBlur(out, width, height, 1)
+			for i, c := range out {
+				c = c.Add(c.Subtract(blurred[i]).MulScalar(e.amount))
+				out[i] = Color{math.Max(0, c.r), math.Max(0, c.g), math.Max(0, c.b)}
+			}
+		} else if e.kind == GrainEffect {
+			// grain is stronger in dark areas like on film, the same for all channels
+			for i, c := range out {
+				h := hash(seed, uint64(i))
+				n := (hashFloat(h) + hashFloat(h+1) + hashFloat(h+2) - 1.5) * 2
+				l := config.luminance(c)
+				out[i] = c.MulScalar(math.Max(0, 1+e.amount*n/math.Sqrt(math.Max(l, 0.01))))
+			}
+		} else if e.kind == LUTEffect {
+			// grading LUTs expect sRGB encoded values
+			for i, c := range out {
+				c = config.toLinearSRGB(c)
+				c = e.lut.lookup(Color{LinearToSRGB(c.r), LinearToSRGB(c.g), LinearToSRGB(c.b)})
+				out[i] = config.fromLinearSRGB(Color{SRGBToLinear(c.r), SRGBToLinear(c.g), SRGBToLinear(c.b)})
+			}
+		}
+	}
+	return out
+}
+
+// bilinear returns canvas interpolated at a position in pixels, positions outside are clamped to the border
+func bilinear(canvas []Color, width, height int, x, y float64) Color {
+	x = math.Max(0, math.Min(float64(width-1), x))
+	y = math.Max(0, math.Min(float64(height-1), y))
+	x0, y0 := int(x), int(y)
+	x1, y1 := clampInt(x0+1, 0, width-1), clampInt(y0+1, 0, height-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+	top := canvas[y0*width+x0].MulScalar(1 - fx).Add(canvas[y0*width+x1].MulScalar(fx))
+	bottom := canvas[y1*width+x0].MulScalar(1 - fx).Add(canvas[y1*width+x1].MulScalar(fx))
+	return top.MulScalar(1 - fy).Add(bottom.MulScalar(fy))
+}
+
+// gaussianBlur approximates Gaussian blur of deviation sigma with three box blurs
+func gaussianBlur(canvas []Color, width, height int, sigma float64) []Color {
+	radius := int(math.Round((math.Sqrt(4*sigma*sigma+1) - 1) / 2))
+	if radius < 1 {
+		radius = 1
+	}
+	out := canvas
+	for i := 0; i < 3; i++ {
+		out = boxBlur(out, width, height, radius, false)
+		out = boxBlur(out, width, height, radius, true)
+	}
+	return out
+}
+
+// boxBlur averages pixels within radius along rows or columns, pixels past the border repeat the border
+func boxBlur(canvas []Color, width, height, radius int, vertical bool) []Color {
+	out := make([]Color, len(canvas))
+	length, lines := width, height
+	if vertical {
+		length, lines = height, width
+	}
+	at := func(line, i int) int {
+		i = clampInt(i, 0, length-1)
+		if vertical {
+			return i*width + line
+		}
+		return line*width + i
+	}
+	n := float64(2*radius + 1)
+	for line := 0; line < lines; line++ {
+		sum := Color{0, 0, 0}
+		for i := -radius; i <= radius; i++ {
+			sum = sum.Add(canvas[at(line, i)])
+		}
+		for i := 0; i < length; i++ {
+			out[at(line, i)] = sum.DivScalar(n)
+			sum = sum.Add(canvas[at(line, i+radius+1)]).Subtract(canvas[at(line, i-radius)])
+		}
+	}
+	return out
+}
@@ -1,31 +1,33 @@
 package main
 
 import (
-	"math/rand"
+	"math"
 )
 
-func RandFloat(generator rand.Rand) float64 {
+// pcg hashes value with a single step of PCG generator and its RXS-M-XS output permutation
+func pcg(v uint64) uint64 {
+	state := v*6364136223846793005 + 1442695040888963407
+	word := ((state >> ((state >> 59) + 5)) ^ state) * 12605985483714917081
+	return (word >> 43) ^ word
+}
+
+func RandFloat(generator *Sampler) float64 {
 	return generator.Float64()
 }
 
-func RandInUnitSphere(generator rand.Rand) Tuple {
-	p := Tuple{0, 0, 0, 0}
-	for {
-		p = (Tuple{RandFloat(generator), RandFloat(generator), RandFloat(generator), 1}.Subtract(Tuple{0.5, 0.5, 0.5, 0})).MulScalar(2.0)
-		if p.Magnitude()*p.Magnitude() < 1.0 {
-			break
-		}
-	}
-	return p
+// RandInUnitSphere returns uniformly distributed point inside unit sphere using three dimensions of the sampler
+func RandInUnitSphere(generator *Sampler) Tuple {
+	z := 1 - 2*RandFloat(generator)
+	phi := 2 * math.Pi * RandFloat(generator)
+	radius := math.Cbrt(RandFloat(generator))
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	return Tuple{r * math.Cos(phi), r * math.Sin(phi), z, 0}.MulScalar(radius)
 }
 
-func RandInUnitHemisphere(generator rand.Rand, normal Tuple) Tuple {
-	p := Tuple{0, 0, 0, 0}
-	for {
-		p = (Tuple{RandFloat(generator), RandFloat(generator), RandFloat(generator), 1}.Subtract(Tuple{0.5, 0.5, 0.5, 0})).MulScalar(2.0)
-		if p.Dot(normal)/(p.Magnitude()*normal.Magnitude()) >= 0.0 {
-			break
-		}
+func RandInUnitHemisphere(generator *Sampler, normal Tuple) Tuple {
+	p := RandInUnitSphere(generator)
+	if p.Dot(normal) < 0 {
+		return p.Negate()
 	}
 	return p
 }
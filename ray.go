@@ -1,8 +1,11 @@
 package main
 
 // Ray struct represents a ray with origin and a direction
+// width and spread describe a cone around the ray covering the pixel footprint
 type Ray struct {
 	origin, direction Tuple
+	width, spread     float64
+	time              float64
 }
 
 // Position returns point after traveling distance `t` along a vector
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// orders in which tiles are rendered
+const (
+	ScanlineOrder = iota
+	SpiralOrder
+	HilbertOrder
+)
+
+// jobSamples is the number of samples of a tile rendered by a single job
+const jobSamples = 16
+
+// Settings controls how frames are rendered
+type Settings struct {
+	samples  int    // target number of samples of every pixel, the maximum in adaptive mode
+	seed     uint64 // seed of random numbers of all samples
+	sampler  int    // sequence of samples
+	tileSize int
+	order    int
+
+	adaptive   float64 // relative error at which pixels stop being sampled, 0 to sample all pixels equally
+	minSamples int     // number of samples of every pixel before its error is estimated
+
+	progressive   bool          // render passes of jobSamples samples over the whole image
+	writePasses   int           // write the image every number of passes, 0 to disable
+	writeInterval time.Duration // write the image after this much time, 0 to disable
+
+	checkpointInterval time.Duration // save a checkpoint after this much time, 0 to save only when stopped and finished
+
+	timeLimit time.Duration // render passes until this much time of all frames is used, 0 to disable
+
+	filter         Filter
+	filterSampling bool // distribute samples of a pixel by the filter instead of splatting them to neighbours
+
+	aovs []int // AOVs rendered along with the beauty image
+}
+
+// Tile is a rectangle of pixels from x0, y0 up to but not including x1, y1
+type Tile struct {
+	x0, y0, x1, y1 int
+}
+
+// Film accumulates sums of samples of all pixels, a tile is written by one worker at a time,
+// results of jobs of a tile are added in the order of their samples, so that sums do not depend on the number of workers,
+// samples are splatted into the pixels around them, so every tile has its own sums of the tile extended by the margin
+type Film struct {
+	width, height int
+	margin        int         // number of pixels around a pixel reached by its samples
+	splats        [][]Color   // sums of samples weighted by the filter of every extended tile
+	weights       [][]float64 // sums of weights of the filter of every extended tile
+	sums          []float64   // sums of luminance of samples of every pixel
+	counts        []int       // number of samples of every pixel
+	squares       []float64   // sums of squared luminance of samples, used to estimate variance
+	done          []bool      // pixels no longer sampled in adaptive mode
+	kinds         []int       // AOVs rendered into the film
+	aovs          [][]Color   // sums of own samples of every pixel of every AOV
+	tiles         []Tile
+	locks         []sync.Mutex // one for every tile
+	tileSize      int
+	seed          uint64
+
+	base    []int               // number of samples of every pixel when the current run started
+	next    []int               // offset of the next job of every tile to be added in the current run
+	pending []map[int]jobResult // results of jobs of every tile finished before the jobs preceding them
+}
+
+// Job renders a number of samples of a single tile, starting at offset from the samples the pixels had when the run started
+type Job struct {
+	tile, samples, offset int
+}
+
+// jobResult holds samples of a job until they can be added to the film, buffer and weights cover the extended tile
+type jobResult struct {
+	samples int
+	buffer  []Color
+	weights []float64
+	sums    []float64
+	squares []float64
+	counts  []int
+	aovs    [][]Color
+}
+
+// jobQueue is a queue of jobs of a single worker
+type jobQueue struct {
+	mutex sync.Mutex
+	jobs  []Job
+}
+
+// Scheduler hands out jobs from queues of workers, a worker with an empty queue steals from the back of the longest queue
+type Scheduler struct {
+	queues []jobQueue
+}
+
+func getFilm(width, height, tileSize, order, margin int, kinds []int) *Film {
+	columns := (width + tileSize - 1) / tileSize
+	rows := (height + tileSize - 1) / tileSize
+	f := &Film{width, height, margin, nil, nil, make([]float64, width*height), make([]int, width*height), make([]float64, width*height), make([]bool, width*height), kinds, make([][]Color, len(kinds)), nil, make([]sync.Mutex, columns*rows), tileSize, 0, nil, nil, nil}
+	for i := range f.aovs {
+		f.aovs[i] = make([]Color, width*height)
+	}
+	for _, c := range tileOrder(columns, rows, order) {
+		x0, y0 := c[0]*tileSize, c[1]*tileSize
+		x1, y1 := x0+tileSize, y0+tileSize
+		if x1 > width {
+			x1 = width
+		}
+		if y1 > height {
+			y1 = height
+		}
+		f.tiles = append(f.tiles, Tile{x0, y0, x1, y1})
+		n := (x1 - x0 + 2*margin) * (y1 - y0 + 2*margin)
+		f.splats = append(f.splats, make([]Color, n))
+		f.weights = append(f.weights, make([]float64, n))
+	}
+	return f
+}
+
+// margin returns number of pixels around a pixel its samples are splatted to
+func (s Settings) margin() int {
+	if s.filterSampling {
+		return 0
+	}
+	return s.filter.margin()
+}
+
+// extent returns the bottom left corner and the size of the tile extended by the margin
+func (f *Film) extent(tile int) (int, int, int, int) {
+	t := f.tiles[tile]
+	return t.x0 - f.margin, t.y0 - f.margin, t.x1 - t.x0 + 2*f.margin, t.y1 - t.y0 + 2*f.margin
+}
+
+// tileOrder returns column and row of every tile in the order of rendering, rows are counted from the bottom
+func tileOrder(columns, rows, order int) [][2]int {
+	tiles := make([][2]int, 0, columns*rows)
+	inside := func(x, y int) bool {
+		return x >= 0 && x < columns && y >= 0 && y < rows
+	}
+	if order == SpiralOrder {
+		// walk a square spiral out of the center, skipping positions outside of the image
+		x, y := (columns-1)/2, rows/2
+		dx, dy := 1, 0
+		for step := 1; len(tiles) < columns*rows; step++ {
+			for turn := 0; turn < 2; turn++ {
+				for i := 0; i < step; i++ {
+					if inside(x, y) {
+						tiles = append(tiles, [2]int{x, y})
+					}
+					x, y = x+dx, y+dy
+				}
+				dx, dy = -dy, dx
+			}
+		}
+	} else if order == HilbertOrder {
+		n := 1
+		for n < columns || n < rows {
+			n *= 2
+		}
+		for d := 0; d < n*n; d++ {
+			if x, y := hilbert(n, d); inside(x, y) {
+				tiles = append(tiles, [2]int{x, y})
+			}
+		}
+	} else {
+		for y := rows - 1; y >= 0; y-- {
+			for x := 0; x < columns; x++ {
+				tiles = append(tiles, [2]int{x, y})
+			}
+		}
+	}
+	return tiles
+}
+
+// hilbert returns position of the d-th point of a Hilbert curve filling n by n square
+func hilbert(n, d int) (int, int) {
+	x, y := 0, 0
+	for s := 1; s < n; s *= 2 {
+		rx := 1 & (d / 2)
+		ry := 1 & (d ^ rx)
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+		x += s * rx
+		y += s * ry
+		d /= 4
+	}
+	return x, y
+}
+
+// add accumulates samples of a job rendered into buffers of the size of the tile, results of jobs that are ahead are kept for later
+func (f *Film) add(job Job, result jobResult) {
+	f.locks[job.tile].Lock()
+	defer f.locks[job.tile].Unlock()
+	if job.offset != f.next[job.tile] {
+		pending := jobResult{result.samples, append([]Color(nil), result.buffer...), append([]float64(nil), result.weights...),
+			append([]float64(nil), result.sums...), append([]float64(nil), result.squares...), append([]int(nil), result.counts...), make([][]Color, len(result.aovs))}
+		for k := range result.aovs {
+			pending.aovs[k] = append([]Color(nil), result.aovs[k]...)
+		}
+		f.pending[job.tile][job.offset] = pending
+		return
+	}
+	f.accumulate(job.tile, result)
+	f.next[job.tile] += job.samples
+	for {
+		result, ok := f.pending[job.tile][f.next[job.tile]]
+		if !ok {
+			return
+		}
+		delete(f.pending[job.tile], f.next[job.tile])
+		f.accumulate(job.tile, result)
+		f.next[job.tile] += result.samples
+	}
+}
+
+func (f *Film) accumulate(tile int, result jobResult) {
+	splats, weights := f.splats[tile], f.weights[tile]
+	for j := range splats {
+		splats[j] = splats[j].Add(result.buffer[j])
+		weights[j] += result.weights[j]
+	}
+	t := f.tiles[tile]
+	i := 0
+	for y := t.y0; y < t.y1; y++ {
+		for x := t.x0; x < t.x1; x++ {
+			f.sums[y*f.width+x] += result.sums[i]
+			f.squares[y*f.width+x] += result.squares[i]
+			f.counts[y*f.width+x] += result.counts[i]
+			for k := range f.aovs {
+				f.aovs[k][y*f.width+x] = f.aovs[k][y*f.width+x].Add(result.aovs[k][i])
+			}
+			i++
+		}
+	}
+}
+
+// converged tells if the standard error of the mean luminance of the pixel relative to the mean is below threshold
+func (f *Film) converged(i int, threshold float64) bool {
+	n := float64(f.counts[i])
+	if n < 2 {
+		return false
+	}
+	mean := f.sums[i] / n
+	variance := math.Max(0, (f.squares[i]/n-mean*mean)*n/(n-1))
+	// black pixels without any variance are converged, the floor keeps dark pixels from taking all samples
+	return math.Sqrt(variance/n) <= threshold*math.Max(mean, 1e-3)
+}
+
+// budget sets number of samples a job adds to every pixel of the tile, converged pixels get none
+func (f *Film) budget(job Job, settings Settings, budget []int) {
+	t := f.tiles[job.tile]
+	j := 0
+	for y := t.y0; y < t.y1; y++ {
+		for x := t.x0; x < t.x1; x++ {
+			i := y*f.width + x
+			budget[j] = job.samples
+			if f.base[i]+job.offset+budget[j] > settings.samples {
+				budget[j] = settings.samples - f.base[i] - job.offset
+				if budget[j] < 0 {
+					budget[j] = 0
+				}
+			}
+			if settings.adaptive > 0 && f.done[i] {
+				budget[j] = 0
+			}
+			j++
+		}
+	}
+}
+
+// active marks pixels that are done and returns jobSamples for every tile with pixels that are not, it is called between passes,
+// a pixel is done once it and all its neighbours are converged, so that pixels which missed rare bright paths keep being sampled
+func (f *Film) active(settings Settings) ([]int, bool) {
+	converged := make([]bool, len(f.counts))
+	for i := range f.counts {
+		converged[i] = f.counts[i] >= settings.minSamples && f.converged(i, settings.adaptive)
+	}
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			done := true
+			for ny := y - 1; ny <= y+1 && done; ny++ {
+				for nx := x - 1; nx <= x+1; nx++ {
+					if nx >= 0 && nx < f.width && ny >= 0 && ny < f.height && !converged[ny*f.width+nx] {
+						done = false
+						break
+					}
+				}
+			}
+			f.done[y*f.width+x] = done || f.counts[y*f.width+x] >= settings.samples
+		}
+	}
+
+	pass := make([]int, len(f.tiles))
+	any := false
+	for tile, t := range f.tiles {
+		for y := t.y0; y < t.y1 && pass[tile] == 0; y++ {
+			for x := t.x0; x < t.x1; x++ {
+				if !f.done[y*f.width+x] {
+					pass[tile] = jobSamples
+					any = true
+					break
+				}
+			}
+		}
+	}
+	return pass, any
+}
+
+// heatmap shows number of samples of every pixel relative to the most sampled pixel, from blue through green to red,
+// so that renders with unlimited samples are shown as well
+func (f *Film) heatmap() []Color {
+	maximum := 1
+	for _, n := range f.counts {
+		if n > maximum {
+			maximum = n
+		}
+	}
+	canvas := make([]Color, len(f.counts))
+	for i, n := range f.counts {
+		v := math.Min(1, float64(n)/float64(maximum))
+		if v < 0.5 {
+			canvas[i] = Color{0, 2 * v, 1 - 2*v}
+		} else {
+			canvas[i] = Color{2*v - 1, 2 - 2*v, 0}
+		}
+	}
+	return canvas
+}
+
+// minWeight is the smallest sum of weights of a pixel which is resolved, filters with negative lobes
+// give smaller sums to pixels reached only by a few samples at the edge of the filter
+const minWeight = 1e-3
+
+// resolve returns weighted average of samples splatted into every pixel,
+// averages pushed below zero by negative lobes of the filter are clamped
+func (f *Film) resolve() []Color {
+	pixels, weights, _, _, _ := f.snapshot()
+	canvas := make([]Color, len(pixels))
+	for i := range pixels {
+		if weights[i] > minWeight {
+			c := pixels[i].DivScalar(weights[i])
+			canvas[i] = Color{math.Max(0, c.r), math.Max(0, c.g), math.Max(0, c.b)}
+		}
+	}
+	return canvas
+}
+
+// remaining returns number of samples every tile needs to reach the target
+func (f *Film) remaining(target int) []int {
+	remaining := make([]int, len(f.tiles))
+	for i, t := range f.tiles {
+		fewest := target
+		for y := t.y0; y < t.y1; y++ {
+			for x := t.x0; x < t.x1; x++ {
+				if f.counts[y*f.width+x] < fewest {
+					fewest = f.counts[y*f.width+x]
+				}
+			}
+		}
+		remaining[i] = target - fewest
+	}
+	return remaining
+}
+
+// snapshot returns weighted sums and weights of all pixels with sums of own samples and counts,
+// every tile is copied while no samples are being added to it and tiles are summed in a fixed order
+func (f *Film) snapshot() ([]Color, []float64, []float64, []float64, []int) {
+	pixels := make([]Color, len(f.counts))
+	weights := make([]float64, len(f.counts))
+	sums := make([]float64, len(f.sums))
+	squares := make([]float64, len(f.squares))
+	counts := make([]int, len(f.counts))
+	for i, t := range f.tiles {
+		f.locks[i].Lock()
+		x0, y0, w, h := f.extent(i)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				if x0+x < 0 || x0+x >= f.width || y0+y < 0 || y0+y >= f.height {
+					continue
+				}
+				p := (y0+y)*f.width + x0 + x
+				pixels[p] = pixels[p].Add(f.splats[i][y*w+x])
+				weights[p] += f.weights[i][y*w+x]
+			}
+		}
+		for y := t.y0; y < t.y1; y++ {
+			a, b := y*f.width+t.x0, y*f.width+t.x1
+			copy(sums[a:b], f.sums[a:b])
+			copy(squares[a:b], f.squares[a:b])
+			copy(counts[a:b], f.counts[a:b])
+		}
+		f.locks[i].Unlock()
+	}
+	return pixels, weights, sums, squares, counts
+}
+
+// snapshotAOVs returns sums of every AOV, the average is taken unless sums are requested
+func (f *Film) snapshotAOVs(sums bool) [][]Color {
+	canvases := make([][]Color, len(f.aovs))
+	for k := range canvases {
+		canvases[k] = make([]Color, len(f.counts))
+	}
+	for i, t := range f.tiles {
+		f.locks[i].Lock()
+		for y := t.y0; y < t.y1; y++ {
+			for x := t.x0; x < t.x1; x++ {
+				p := y*f.width + x
+				for k := range f.aovs {
+					if sums {
+						canvases[k][p] = f.aovs[k][p]
+					} else if f.counts[p] > 0 {
+						canvases[k][p] = f.aovs[k][p].DivScalar(float64(f.counts[p]))
+					}
+				}
+			}
+		}
+		f.locks[i].Unlock()
+	}
+	return canvases
+}
+
+// resolveAOVs returns average of own samples of every pixel of every AOV
+func (f *Film) resolveAOVs() [][]Color {
+	return f.snapshotAOVs(false)
+}
+
+// restore puts weighted sums and weights of pixels into the tiles they belong to
+func (f *Film) restore(pixels []Color, weights []float64) {
+	for i, t := range f.tiles {
+		x0, y0, w, _ := f.extent(i)
+		for y := t.y0; y < t.y1; y++ {
+			for x := t.x0; x < t.x1; x++ {
+				f.splats[i][(y-y0)*w+x-x0] = pixels[y*f.width+x]
+				f.weights[i][(y-y0)*w+x-x0] = weights[y*f.width+x]
+			}
+		}
+	}
+}
+
+// getScheduler deals jobs round robin to workers in passes over the tiles, every pass adds up to jobSamples samples to a tile
+func getScheduler(remaining []int, workers int) *Scheduler {
+	s := &Scheduler{make([]jobQueue, workers)}
+	i := 0
+	for done := 0; ; done += jobSamples {
+		added := false
+		for tile, samples := range remaining {
+			if samples <= done {
+				continue
+			}
+			n := jobSamples
+			if samples-done < n {
+				n = samples - done
+			}
+			q := &s.queues[i%workers]
+			q.jobs = append(q.jobs, Job{tile, n, done})
+			added = true
+			i++
+		}
+		if !added {
+			return s
+		}
+	}
+}
+
+// next returns the next job of a worker, false when there is nothing left to do
+func (s *Scheduler) next(worker int) (Job, bool) {
+	q := &s.queues[worker]
+	q.mutex.Lock()
+	if len(q.jobs) > 0 {
+		job := q.jobs[0]
+		q.jobs = q.jobs[1:]
+		q.mutex.Unlock()
+		return job, true
+	}
+	q.mutex.Unlock()
+
+	for {
+		victim, longest := -1, 0
+		for i := range s.queues {
+			s.queues[i].mutex.Lock()
+			if len(s.queues[i].jobs) > longest {
+				victim, longest = i, len(s.queues[i].jobs)
+			}
+			s.queues[i].mutex.Unlock()
+		}
+		if victim < 0 {
+			return Job{}, false
+		}
+		q := &s.queues[victim]
+		q.mutex.Lock()
+		// the queue may have been emptied since it was chosen
+		if len(q.jobs) > 0 {
+			job := q.jobs[len(q.jobs)-1]
+			q.jobs = q.jobs[:len(q.jobs)-1]
+			q.mutex.Unlock()
+			return job, true
+		}
+		q.mutex.Unlock()
+	}
+}
+
+// Progress counts traced samples of all pixels and prints progress of a frame,
+// the ETA uses the number of samples per second of all workers smoothed over the last seconds
+type Progress struct {
+	start       time.Time
+	deadline    time.Time // end of the time limit, zero without a limit
+	done, total int64
+
+	mutex    sync.Mutex
+	last     time.Time // time of the last measurement of the rate
+	lastDone int64
+	rate     float64 // samples per second
+}
+
+// Renderer renders frames of a scene on all cores
+type Renderer struct {
+	camera   Camera
+	world    *HittableList
+	shutter  [2]float64
+	config   ColorConfig
+	settings Settings
+
+	output     func(canvas []Color) // writes intermediate images in progressive mode
+	checkpoint func(film *Film)     // saves state of the film so the render can be resumed
+	stopped    int32                // set once workers should not start new jobs
+	paused     int32                // set while workers should wait before new jobs
+	deadline   time.Time            // end of the time limit of the current frame, zero without a limit
+
+	mutex    sync.Mutex
+	film     *Film     // film of the frame being rendered, for previews
+	progress *Progress // progress of the frame being rendered
+}
+
+// rateWindow is the time over which the rate of samples is smoothed
+const rateWindow = 10 * time.Second
+
+func getProgress(deadline time.Time) *Progress {
+	now := time.Now()
+	return &Progress{start: now, deadline: deadline, last: now}
+}
+
+func (p *Progress) add(n int) {
+	done := atomic.AddInt64(&p.done, int64(n))
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	dt := now.Sub(p.last)
+	if dt < 250*time.Millisecond {
+		return
+	}
+	current := float64(done-p.lastDone) / dt.Seconds()
+	if p.rate == 0 {
+		p.rate = current
+	} else {
+		p.rate += (current - p.rate) * (1 - math.Exp(-float64(dt)/float64(rateWindow)))
+	}
+	p.last, p.lastDone = now, done
+	p.print(done)
+}
+
+// estimate returns percentage of the frame that is done and the time left
+func (p *Progress) estimate(done int64) (float64, time.Duration) {
+	var percent float64
+	var eta time.Duration
+	if !p.deadline.IsZero() {
+		percent = float64(time.Since(p.start)) / float64(p.deadline.Sub(p.start)) * 100
+		eta = time.Until(p.deadline)
+	} else {
+		percent = float64(done) / float64(p.total) * 100
+		if p.rate > 0 {
+			eta = time.Duration(float64(p.total-done) / p.rate * float64(time.Second))
+		}
+	}
+	return math.Min(percent, 100), eta
+}
+
+func (p *Progress) print(done int64) {
+	percent, eta := p.estimate(done)
+	fmt.Printf("\r%.2f%% % 15s elapsed, %.3f Msamples/s, ETA: % 15s", percent, time.Since(p.start).Round(time.Second), p.rate/1e6, eta.Round(time.Second))
+}
+
+// stop lets workers finish their current jobs and makes render return early
+func (r *Renderer) stop() {
+	atomic.StoreInt32(&r.stopped, 1)
+}
+
+func (r *Renderer) isStopped() bool {
+	return atomic.LoadInt32(&r.stopped) != 0
+}
+
+// pause makes workers wait before their next jobs until the renderer is resumed or stopped
+func (r *Renderer) pause(paused bool) {
+	if paused {
+		atomic.StoreInt32(&r.paused, 1)
+	} else {
+		atomic.StoreInt32(&r.paused, 0)
+	}
+}
+
+func (r *Renderer) isPaused() bool {
+	return atomic.LoadInt32(&r.paused) != 0
+}
+
+// current returns the film and the progress of the frame being rendered, nil before the first frame
+func (r *Renderer) current() (*Film, *Progress) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.film, r.progress
+}
+
+// expired tells if the time limit of the frame is over
+func (r *Renderer) expired() bool {
+	return !r.deadline.IsZero() && time.Now().After(r.deadline)
+}
+
+// run renders jobs of the scheduler on all cores and returns once all of them are done or the renderer is stopped
+func (r *Renderer) run(f *Film, scheduler *Scheduler, frameTime float64, progress *Progress) {
+	f.base = append([]int(nil), f.counts...)
+	f.next = make([]int, len(f.tiles))
+	f.pending = make([]map[int]jobResult, len(f.tiles))
+	for i := range f.pending {
+		f.pending[i] = map[int]jobResult{}
+	}
+	// animated cameras are built for the frame once instead of for every ray
+	camera := r.camera
+	if m, ok := camera.(MotionCamera); ok {
+		camera = m.frame(frameTime+r.shutter[0], frameTime+r.shutter[1])
+	}
+
+	var wg sync.WaitGroup
+	for i := range scheduler.queues {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			generator := getSampler(r.settings.sampler, f.seed, r.settings.samples)
+			filter := r.settings.filter
+			extended := (f.tileSize + 2*f.margin) * (f.tileSize + 2*f.margin)
+			result := jobResult{0, make([]Color, extended), make([]float64, extended), make([]float64, f.tileSize*f.tileSize),
+				make([]float64, f.tileSize*f.tileSize), make([]int, f.tileSize*f.tileSize), make([][]Color, len(f.aovs))}
+			for k := range result.aovs {
+				result.aovs[k] = make([]Color, f.tileSize*f.tileSize)
+			}
+			budget := make([]int, f.tileSize*f.tileSize)
+			// values of the first hit are reset for every sample
+			aovSample := &AOVSample{}
+			for !r.isStopped() && !r.expired() {
+				if r.isPaused() {
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				job, ok := scheduler.next(i)
+				if !ok {
+					return
+				}
+				t := f.tiles[job.tile]
+				x0, y0, w, h := f.extent(job.tile)
+				result.samples = job.samples
+				result.buffer, result.weights = result.buffer[:w*h], result.weights[:w*h]
+				for j := range result.buffer {
+					result.buffer[j] = Color{0, 0, 0}
+					result.weights[j] = 0
+				}
+				for j := range result.counts {
+					result.sums[j] = 0
+					result.squares[j] = 0
+					result.counts[j] = 0
+					for k := range result.aovs {
+						result.aovs[k][j] = Color{0, 0, 0}
+					}
+				}
+				f.budget(job, r.settings, budget)
+				traced := 0
+				for s := 0; s < job.samples; s++ {
+					j := -1
+					for y := t.y0; y < t.y1; y++ {
+						for x := t.x0; x < t.x1; x++ {
+							j++
+							if s >= budget[j] {
+								continue
+							}
+							i := y*f.width + x
+							generator.start(x, y, f.base[i]+job.offset+s)
+							col := Color{0, 0, 0}
+							// offset of the sample from the center of the pixel, distributed by the filter only when asked to
+							var dx, dy float64
+							sign := 1.0
+							if r.settings.filterSampling {
+								var sx, sy float64
+								dx, sx = filter.sample(RandFloat(generator))
+								dy, sy = filter.sample(RandFloat(generator))
+								sign = sx * sy
+							} else {
+								dx = RandFloat(generator) - 0.5
+								dy = RandFloat(generator) - 0.5
+							}
+							u := (float64(x) + 0.5 + dx) / float64(f.width)
+							v := (float64(y) + 0.5 + dy) / float64(f.height)
+							shutterTime := frameTime + r.shutter[0] + RandFloat(generator)*(r.shutter[1]-r.shutter[0])
+							ray, ok := camera.getRay(u, v, shutterTime, generator)
+
+							var sample *AOVSample
+							if len(f.aovs) > 0 {
+								*aovSample = AOVSample{}
+								sample = aovSample
+							}
+							if ok {
+								col = colorize(ray, r.world, r.config, 0, generator, sample)
+							}
+							if sample != nil {
+								values := sample.values(col)
+								for k, kind := range f.kinds {
+									result.aovs[k][j] = result.aovs[k][j].Add(values[kind])
+								}
+							}
+
+							if r.settings.filterSampling {
+								k := (y-y0)*w + x - x0
+								result.buffer[k] = result.buffer[k].Add(col.MulScalar(sign))
+								result.weights[k] += sign
+							} else {
+								for py := y - f.margin; py <= y+f.margin; py++ {
+									for px := x - f.margin; px <= x+f.margin; px++ {
+										weight := filter.evaluate(dx-float64(px-x), dy-float64(py-y))
+										if weight == 0 {
+											continue
+										}
+										k := (py-y0)*w + px - x0
+										result.buffer[k] = result.buffer[k].Add(col.MulScalar(weight))
+										result.weights[k] += weight
+									}
+								}
+							}
+							l := r.config.luminance(col)
+							result.sums[j] += l
+							result.squares[j] += l * l
+							result.counts[j]++
+							traced++
+						}
+					}
+				}
+				f.add(job, result)
+				progress.add(traced)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// render adds samples to the film until every pixel has the target number of samples, shutter is relative to the time of the frame,
+// in progressive mode the current average is passed to output after passes over the whole image,
+// with a time limit passes are rendered until the deadline of the renderer,
+// returns false when the renderer was stopped before the film was finished
+func (r *Renderer) render(film *Film, frameTime float64) bool {
+	cpus := runtime.NumCPU()
+	runtime.GOMAXPROCS(cpus)
+
+	// in adaptive mode every pixel gets the minimum number of samples first, the total is an upper bound
+	target := r.settings.samples
+	if r.settings.adaptive > 0 {
+		target = r.settings.minSamples
+	}
+	remaining := film.remaining(target)
+	progress := getProgress(r.deadline)
+	for _, n := range film.counts {
+		if n < r.settings.samples {
+			progress.total += int64(r.settings.samples - n)
+		}
+	}
+	if progress.total == 0 {
+		return true
+	}
+	r.mutex.Lock()
+	r.film, r.progress = film, progress
+	r.mutex.Unlock()
+
+	done := make(chan bool)
+	var saving sync.WaitGroup
+	if r.settings.checkpointInterval > 0 {
+		saving.Add(1)
+		go func() {
+			defer saving.Done()
+			ticker := time.NewTicker(r.settings.checkpointInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					r.checkpoint(film)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	if !r.settings.progressive && r.settings.adaptive == 0 && r.deadline.IsZero() {
+		r.run(film, getScheduler(remaining, cpus), frameTime, progress)
+	} else {
+		written := time.Now()
+		for pass := 1; !r.isStopped() && !r.expired(); pass++ {
+			// passes bring all pixels to the target first, adaptive passes then add samples to tiles with pixels that are not converged
+			passSamples := make([]int, len(remaining))
+			scheduled := false
+			for i, n := range remaining {
+				if n > jobSamples {
+					n = jobSamples
+				}
+				passSamples[i] = n
+				remaining[i] -= n
+				scheduled = scheduled || n > 0
+			}
+			if !scheduled && r.settings.adaptive > 0 {
+				passSamples, scheduled = film.active(r.settings)
+			}
+			if !scheduled {
+				break
+			}
+			r.run(film, getScheduler(passSamples, cpus), frameTime, progress)
+			if r.settings.progressive && !r.isStopped() && ((r.settings.writePasses > 0 && pass%r.settings.writePasses == 0) || (r.settings.writeInterval > 0 && time.Since(written) >= r.settings.writeInterval)) {
+				r.output(film.resolve())
+				written = time.Now()
+			}
+		}
+	}
+	// the caller may save a checkpoint too, so periodic saving has to be over
+	close(done)
+	saving.Wait()
+
+	progress.print(atomic.LoadInt64(&progress.done))
+	fmt.Printf("\nRendering took %s\n", time.Since(progress.start))
+	return !r.isStopped()
+}
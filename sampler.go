@@ -0,0 +1,320 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// sequences of samplers
+const (
+	Independent = iota
+	Stratified
+	Halton
+	Sobol
+	BlueNoise
+)
+
+// dimensions used by the camera, followed by a fixed number of dimensions of every bounce,
+// so that a dimension means the same thing in all samples of a pixel
+const (
+	cameraDimensions = 8
+	bounceDimensions = 8
+)
+
+// Sampler hands out numbers of a single sample of a pixel one dimension after another, every number depends only on
+// the seed, pixel, sample and dimension, so samples are the same no matter which worker renders them,
+// dimensions are generated in pairs, so that consecutive dimensions are well distributed in 2D
+type Sampler struct {
+	sequence int
+	seed     uint64
+	samples  int // expected number of samples of a pixel, used by stratified sampling
+
+	x, y, sample int
+	dimension    int
+	second       float64 // second number of the current pair
+}
+
+// haltonPrimes are bases of Halton sequence, dimensions past them are sampled independently
+var haltonPrimes = []int{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131}
+
+// sobolDirections are direction numbers of the second dimension of Sobol sequence, the first one is the van der Corput sequence
+var sobolDirections = func() [32]uint32 {
+	var v [32]uint32
+	v[0] = 1 << 31
+	for i := 1; i < 32; i++ {
+		v[i] = v[i-1] ^ (v[i-1] >> 1)
+	}
+	return v
+}()
+
+// blueNoiseSize is the size of the tiled blue noise texture
+const blueNoiseSize = 64
+
+var blueNoise []float64
+var blueNoiseOnce sync.Once
+
+func getSampler(sequence int, seed uint64, samples int) *Sampler {
+	// stratification of very large numbers of samples is not worth the bigger strata of the first samples
+	if samples > 1<<16 {
+		samples = 1 << 16
+	}
+	if sequence == BlueNoise {
+		blueNoiseOnce.Do(func() {
+			blueNoise = buildBlueNoise(blueNoiseSize)
+		})
+	}
+	return &Sampler{sequence, seed, samples, 0, 0, 0, 0, 0}
+}
+
+// start begins sample of a pixel with the camera dimensions
+func (s *Sampler) start(x, y, sample int) {
+	s.x, s.y, s.sample = x, y, sample
+	s.dimension = 0
+}
+
+// bounce moves to the dimensions of a bounce of the path
+func (s *Sampler) bounce(depth int) {
+	s.dimension = cameraDimensions + depth*bounceDimensions
+}
+
+// Float64 returns number of the next dimension in range [0, 1)
+func (s *Sampler) Float64() float64 {
+	if s.dimension%2 == 1 {
+		s.dimension++
+		return s.second
+	}
+	first, second := s.pair(s.dimension / 2)
+	s.second = second
+	s.dimension++
+	return first
+}
+
+// hash mixes values into a single key
+func hash(values ...uint64) uint64 {
+	h := uint64(0)
+	for _, v := range values {
+		h = pcg(h ^ pcg(v))
+	}
+	return h
+}
+
+// hashFloat turns key into a number in range [0, 1)
+func hashFloat(key uint64) float64 {
+	return float64(pcg(key)>>11) / (1 << 53)
+}
+
+// pair returns numbers of the p-th pair of dimensions of the current sample
+func (s *Sampler) pair(p int) (float64, float64) {
+	pixel := uint64(s.y)<<32 | uint64(s.x)
+	key := hash(s.seed, pixel, uint64(p))
+	if s.sequence == Stratified {
+		// jittered grid with strata visited in a random order, further rounds of samples use new orders
+		m := int(math.Sqrt(float64(s.samples)))
+		if m < 1 {
+			m = 1
+		}
+		cells := m * m
+		round := uint64(s.sample / cells)
+		cell := int(permute(uint32(s.sample%cells), uint32(cells), uint32(hash(key, round))))
+		x := (float64(cell%m) + hashFloat(hash(key, round, uint64(s.sample), 0))) / float64(m)
+		y := (float64(cell/m) + hashFloat(hash(key, round, uint64(s.sample), 1))) / float64(m)
+		return x, y
+	} else if s.sequence == Halton && 2*p+1 < len(haltonPrimes) {
+		// radical inverses with digits scrambled differently in every pixel
+		return radicalInverse(haltonPrimes[2*p], s.sample, hash(key, 0)), radicalInverse(haltonPrimes[2*p+1], s.sample, hash(key, 1))
+	} else if s.sequence == Sobol {
+		// 2D Sobol points with a shuffled index and Owen scrambling, different for every pair of dimensions
+		index := nestedUniformScramble(uint32(s.sample), uint32(hash(key, 0)))
+		x := nestedUniformScramble(sobol(index, 0), uint32(hash(key, 1)))
+		y := nestedUniformScramble(sobol(index, 1), uint32(hash(key, 2)))
+		return float64(x) / (1 << 32), float64(y) / (1 << 32)
+	} else if s.sequence == BlueNoise {
+		// the same scrambled Sobol points in all pixels, shifted by blue noise, so that the error of neighbouring pixels differs most
+		global := hash(s.seed, uint64(p))
+		index := nestedUniformScramble(uint32(s.sample), uint32(hash(global, 0)))
+		x := float64(nestedUniformScramble(sobol(index, 0), uint32(hash(global, 1)))) / (1 << 32)
+		y := float64(nestedUniformScramble(sobol(index, 1), uint32(hash(global, 2)))) / (1 << 32)
+		// every dimension uses the texture with a different offset
+		x += blueNoiseAt(s.x+int(hash(global, 3)%blueNoiseSize), s.y+int(hash(global, 4)%blueNoiseSize))
+		y += blueNoiseAt(s.x+int(hash(global, 5)%blueNoiseSize), s.y+int(hash(global, 6)%blueNoiseSize))
+		return x - math.Floor(x), y - math.Floor(y)
+	}
+	sample := uint64(s.sample)
+	return hashFloat(hash(key, sample, 0)), hashFloat(hash(key, sample, 1))
+}
+
+// radicalInverse mirrors digits of index in given base around the decimal point, every digit is permuted
+// depending on the digits before it (Owen scrambling), so that large bases are well distributed for few samples too
+func radicalInverse(base, index int, key uint64) float64 {
+	inverse := 0.0
+	f := 1 / float64(base)
+	for scale := f; scale > 1e-10; scale *= f {
+		digit := index % base
+		inverse += float64(permute(uint32(digit), uint32(base), uint32(key))) * scale
+		key = hash(key, uint64(digit))
+		index /= base
+	}
+	return inverse
+}
+
+// sobol returns the first or the second dimension of Sobol sequence as a fraction of 2^32
+func sobol(index uint32, dimension int) uint32 {
+	if dimension == 0 {
+		return bits.Reverse32(index)
+	}
+	x := uint32(0)
+	for i := 0; index != 0; i++ {
+		if index&1 != 0 {
+			x ^= sobolDirections[i]
+		}
+		index >>= 1
+	}
+	return x
+}
+
+// laineKarras is a hash that changes only higher bits depending on lower bits
+func laineKarras(x, seed uint32) uint32 {
+	x += seed
+	x ^= x * 0x6c50b47c
+	x ^= x * 0xb82f1e52
+	x ^= x * 0xc7afe638
+	x ^= x * 0x8d22f6e6
+	return x
+}
+
+// nestedUniformScramble is Owen scrambling of a fraction of 2^32
+func nestedUniformScramble(x, seed uint32) uint32 {
+	return bits.Reverse32(laineKarras(bits.Reverse32(x), seed))
+}
+
+// permute returns i-th element of a random permutation of n elements given by key
+func permute(i, n, key uint32) uint32 {
+	w := n - 1
+	w |= w >> 1
+	w |= w >> 2
+	w |= w >> 4
+	w |= w >> 8
+	w |= w >> 16
+	for {
+		i ^= key
+		i *= 0xe170893d
+		i ^= key >> 16
+		i ^= (i & w) >> 4
+		i ^= key >> 8
+		i *= 0x0929eb3f
+		i ^= key >> 23
+		i ^= (i & w) >> 1
+		i *= 1 | key>>27
+		i *= 0x6935fa69
+		i ^= (i & w) >> 11
+		i *= 0x74dcb303
+		i ^= (i & w) >> 2
+		i *= 0x9e501cc3
+		i ^= (i & w) >> 2
+		i *= 0xc860a3df
+		i &= w
+		i ^= i >> 5
+		if i < n {
+			return (i + key) % n
+		}
+	}
+}
+
+func blueNoiseAt(x, y int) float64 {
+	return blueNoise[(y%blueNoiseSize)*blueNoiseSize+x%blueNoiseSize]
+}
+
+// buildBlueNoise generates a tileable blue noise texture with values in range (0, 1) using the void and cluster method
+func buildBlueNoise(size int) []float64 {
+	n := size * size
+	// energy of a point at every toroidal offset
+	kernel := make([]float64, n)
+	for dy := 0; dy < size; dy++ {
+		for dx := 0; dx < size; dx++ {
+			x, y := math.Min(float64(dx), float64(size-dx)), math.Min(float64(dy), float64(size-dy))
+			kernel[dy*size+dx] = math.Exp(-(x*x + y*y) / (2 * 1.5 * 1.5))
+		}
+	}
+	pattern := make([]bool, n)
+	energy := make([]float64, n)
+	toggle := func(i int) {
+		pattern[i] = !pattern[i]
+		sign := 1.0
+		if !pattern[i] {
+			sign = -1
+		}
+		px, py := i%size, i/size
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				energy[y*size+x] += sign * kernel[((y-py+size)%size)*size+(x-px+size)%size]
+			}
+		}
+	}
+	// tightest cluster is the point with the highest energy, largest void is the empty place with the lowest
+	tightest := func() int {
+		best := -1
+		for i := range pattern {
+			if pattern[i] && (best < 0 || energy[i] > energy[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+	largestVoid := func() int {
+		best := -1
+		for i := range pattern {
+			if !pattern[i] && (best < 0 || energy[i] < energy[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	// initial pattern of random points made uniform by moving points from clusters into voids
+	ones := n / 10
+	for k := uint64(0); ones > 0; k++ {
+		if i := int(pcg(k) % uint64(n)); !pattern[i] {
+			toggle(i)
+			ones--
+		}
+	}
+	for {
+		t := tightest()
+		toggle(t)
+		v := largestVoid()
+		toggle(v)
+		if v == t {
+			break
+		}
+	}
+
+	rank := make([]int, n)
+	initial := append([]bool(nil), pattern...)
+	initialEnergy := append([]float64(nil), energy...)
+	count := 0
+	for _, p := range pattern {
+		if p {
+			count++
+		}
+	}
+	// points of the initial pattern are ranked by removing the tightest clusters, then voids are filled
+	for r := count - 1; r >= 0; r-- {
+		t := tightest()
+		toggle(t)
+		rank[t] = r
+	}
+	copy(pattern, initial)
+	copy(energy, initialEnergy)
+	for r := count; r < n; r++ {
+		v := largestVoid()
+		toggle(v)
+		rank[v] = r
+	}
+
+	values := make([]float64, n)
+	for i, r := range rank {
+		values[i] = (float64(r) + 0.5) / float64(n)
+	}
+	return values
+}
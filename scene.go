@@ -0,0 +1,874 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"sort"
+)
+
+// Scene holds the camera and all objects of a scene
+type Scene struct {
+	camera    Camera
+	spheres   []Sphere
+	triangles []Triangle
+	instances []Instance
+	autofocus []int      // pixel to focus on once the scene is built, nil to keep focus distance
+	shutter   [2]float64 // times of opening and closing of the shutter relative to the frame
+	animation *Animation // frames to render, nil renders a single image at time 0
+	files     []string   // files the scene was read from, which identify it in checkpoints
+	color     ColorConfig
+}
+
+type sceneJSON struct {
+	Color     colorJSON                  `json:"color"`
+	Shutter   []float64                  `json:"shutter"`
+	Animation *animationJSON             `json:"animation"`
+	Camera    cameraJSON                 `json:"camera"`
+	Textures  map[string]json.RawMessage `json:"textures"`
+	Materials map[string]materialJSON    `json:"materials"`
+	Objects   []objectJSON               `json:"objects"`
+}
+
+type colorJSON struct {
+	Working string `json:"working"`
+	Display string `json:"display"`
+}
+
+type cameraJSON struct {
+	Type     string    `json:"type"`
+	From     []float64 `json:"from"`
+	At       []float64 `json:"at"`
+	Up       []float64 `json:"up"`
+	Fov      float64   `json:"fov"`
+	Aperture float64   `json:"aperture"`
+	Focus    float64   `json:"focus"`
+	Height   float64   `json:"height"`
+	Stereo   bool      `json:"stereo"`
+	Ipd      float64   `json:"ipd"`
+
+	FocalLength   float64 `json:"focalLength"`
+	SensorWidth   float64 `json:"sensorWidth"`
+	FNumber       float64 `json:"fNumber"`
+	Blades        int     `json:"blades"`
+	BladeRotation float64 `json:"bladeRotation"`
+	Bokeh         string  `json:"bokeh"`
+	Autofocus     []int   `json:"autofocus"`
+
+	Motion []cameraKeyJSON `json:"motion"`
+}
+
+type cameraKeyJSON struct {
+	Time          float64   `json:"time"`
+	From          []float64 `json:"from"`
+	At            []float64 `json:"at"`
+	Up            []float64 `json:"up"`
+	Fov           *float64  `json:"fov"`
+	FocalLength   *float64  `json:"focalLength"`
+	Aperture      *float64  `json:"aperture"`
+	FNumber       *float64  `json:"fNumber"`
+	Focus         *float64  `json:"focus"`
+	Interpolation string    `json:"interpolation"`
+}
+
+type transformJSON struct {
+	Time          float64   `json:"time"`
+	Translate     []float64 `json:"translate"`
+	Rotate        []float64 `json:"rotate"`
+	Scale         []float64 `json:"scale"`
+	Interpolation string    `json:"interpolation"`
+}
+
+type materialKeyJSON struct {
+	Time          float64  `json:"time"`
+	Roughness     *float64 `json:"roughness"`
+	Ior           *float64 `json:"ior"`
+	Specularity   *float64 `json:"specularity"`
+	Strength      *float64 `json:"strength"`
+	Temperature   *float64 `json:"temperature"`
+	Interpolation string   `json:"interpolation"`
+}
+
+type animationJSON struct {
+	Start int     `json:"start"`
+	End   int     `json:"end"`
+	Fps   float64 `json:"fps"`
+}
+
+// nodeJSON describes any node of a texture graph, fields not used by the node type are ignored
+type nodeJSON struct {
+	Type       string            `json:"type"`
+	Color      []float64         `json:"color"`
+	Colors     [][]float64       `json:"colors"`
+	Scale      []float64         `json:"scale"`
+	Offset     []float64         `json:"offset"`
+	Angle      float64           `json:"angle"`
+	File       string            `json:"file"`
+	Filter     string            `json:"filter"`
+	Wrap       string            `json:"wrap"`
+	Mipmap     bool              `json:"mipmap"`
+	Linear     bool              `json:"linear"`
+	Octaves    int               `json:"octaves"`
+	Distortion float64           `json:"distortion"`
+	Ramp       []rampStopJSON    `json:"ramp"`
+	Inputs     []json.RawMessage `json:"inputs"`
+	Factor     json.RawMessage   `json:"factor"`
+	From       []float64         `json:"from"`
+	To         []float64         `json:"to"`
+}
+
+type rampStopJSON struct {
+	Position float64         `json:"position"`
+	Color    json.RawMessage `json:"color"`
+}
+
+type materialJSON struct {
+	Type         string            `json:"type"`
+	Albedo       json.RawMessage   `json:"albedo"`
+	Roughness    json.RawMessage   `json:"roughness"`
+	Ior          json.RawMessage   `json:"ior"`
+	Specularity  json.RawMessage   `json:"specularity"`
+	Emission     json.RawMessage   `json:"emission"`
+	Normal       json.RawMessage   `json:"normal"`
+	Bump         json.RawMessage   `json:"bump"`
+	BumpStrength float64           `json:"bumpStrength"`
+	Strength     *float64          `json:"strength"`
+	Temperature  float64           `json:"temperature"`
+	TwoSided     *bool             `json:"twoSided"`
+	Normalize    bool              `json:"normalize"`
+	Animation    []materialKeyJSON `json:"animation"`
+}
+
+type objectJSON struct {
+	Type     string    `json:"type"`
+	Center   []float64 `json:"center"`
+	Radius   float64   `json:"radius"`
+	File     string    `json:"file"`
+	Material string    `json:"material"`
+	Smooth   bool      `json:"smooth"`
+
+	Transform []transformJSON `json:"transform"`
+}
+
+// sceneLoader resolves named textures of a scene file
+type sceneLoader struct {
+	textures  map[string]json.RawMessage
+	resolved  map[string]Node
+	resolving map[string]bool
+	images    map[string][][]Color
+	data      bool     // nodes being built are data like roughness, so their colors are not converted into the working space
+	files     []string // images read by the loader
+	config    ColorConfig
+}
+
+var materialTypes = map[string]int{
+	"metal":      Metal,
+	"lambertian": Lambertian,
+	"dielectric": Dielectric,
+	"emission":   Emission,
+	"plastic":    Plastic,
+}
+
+var noiseTypes = map[string]int{
+	"perlin":     NoisePerlin,
+	"simplex":    NoiseSimplex,
+	"fbm":        NoiseFBM,
+	"turbulence": NoiseTurbulence,
+	"voronoi":    NoiseVoronoi,
+	"marble":     NoiseMarble,
+	"wood":       NoiseWood,
+}
+
+var workingSpaces = map[string]int{
+	"":       LinearSRGB,
+	"srgb":   LinearSRGB,
+	"acescg": ACEScg,
+}
+
+var displayEncodings = map[string]int{
+	"":       SRGB,
+	"srgb":   SRGB,
+	"rec709": Rec709,
+	"linear": LinearDisplay,
+}
+
+var filterTypes = map[string]int{
+	"":         Nearest,
+	"nearest":  Nearest,
+	"bilinear": Bilinear,
+	"bicubic":  Bicubic,
+}
+
+var wrapTypes = map[string]int{
+	"":       Clamp,
+	"clamp":  Clamp,
+	"repeat": Repeat,
+	"mirror": Mirror,
+}
+
+// interpolation parses interpolation mode of a key, linear by default
+func interpolation(name string) (int, error) {
+	if name == "" || name == "linear" {
+		return LinearInterpolation, nil
+	} else if name == "bezier" {
+		return BezierInterpolation, nil
+	}
+	return 0, fmt.Errorf("unknown interpolation %q", name)
+}
+
+func toTuple(values []float64) (Tuple, error) {
+	if len(values) != 3 {
+		return Tuple{}, fmt.Errorf("expected 3 values, got %v", values)
+	}
+	return Tuple{values[0], values[1], values[2], 0}, nil
+}
+
+func toColor(values []float64) (Color, error) {
+	if len(values) != 3 {
+		return Color{}, fmt.Errorf("expected 3 color values, got %v", values)
+	}
+	return Color{values[0], values[1], values[2]}, nil
+}
+
+// color parses a color of a node, colors of scene files are linear sRGB
+func (l *sceneLoader) color(values []float64) (Color, error) {
+	c, err := toColor(values)
+	if err != nil || l.data {
+		return c, err
+	}
+	return l.config.fromLinearSRGB(c), nil
+}
+
+// dataNode parses a texture reference used as data
+func (l *sceneLoader) dataNode(raw json.RawMessage) (Node, error) {
+	data := l.data
+	l.data = true
+	node, err := l.node(raw)
+	l.data = data
+	return node, err
+}
+
+// named returns texture defined in the textures section of the scene, textures used as colors and as data are built separately
+func (l *sceneLoader) named(name string) (Node, error) {
+	key := fmt.Sprintf("%s:%t", name, l.data)
+	if node, ok := l.resolved[key]; ok {
+		return node, nil
+	}
+	raw, ok := l.textures[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown texture %q", name)
+	}
+	if l.resolving[name] {
+		return nil, fmt.Errorf("texture %q references itself", name)
+	}
+	l.resolving[name] = true
+	node, err := l.node(raw)
+	if err != nil {
+		return nil, fmt.Errorf("texture %q: %v", name, err)
+	}
+	l.resolving[name] = false
+	l.resolved[key] = node
+	return node, nil
+}
+
+// node parses a texture reference: a number, a color, a texture name or an inline node
+func (l *sceneLoader) node(raw json.RawMessage) (Node, error) {
+	var value float64
+	if err := json.Unmarshal(raw, &value); err == nil {
+		c, err := l.color([]float64{value, value, value})
+		return getConstant(c), err
+	}
+	var values []float64
+	if err := json.Unmarshal(raw, &values); err == nil {
+		c, err := l.color(values)
+		if err != nil {
+			return nil, err
+		}
+		return getConstant(c), nil
+	}
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return l.named(name)
+	}
+	var n nodeJSON
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return nil, err
+	}
+	return l.build(n)
+}
+
+func (l *sceneLoader) inputs(n nodeJSON, count int) ([]Node, error) {
+	if len(n.Inputs) != count {
+		return nil, fmt.Errorf("%s node needs %d inputs, got %d", n.Type, count, len(n.Inputs))
+	}
+	nodes := make([]Node, count)
+	for i, raw := range n.Inputs {
+		node, err := l.node(raw)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+func (l *sceneLoader) ramp(stops []rampStopJSON) ([]RampStop, error) {
+	ramp := make([]RampStop, len(stops))
+	for i, stop := range stops {
+		node, err := l.node(stop.Color)
+		if err != nil {
+			return nil, err
+		}
+		ramp[i] = RampStop{stop.Position, node}
+	}
+	return ramp, nil
+}
+
+func (l *sceneLoader) image(file string, linear bool) ([][]Color, error) {
+	key := fmt.Sprintf("%s:%t", file, linear)
+	if texture, ok := l.images[key]; ok {
+		return texture, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l.files = append(l.files, file)
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	texture := loadTexture(img, linear, l.config)
+	l.images[key] = texture
+	return texture, nil
+}
+
+// build creates texture graph node from its description
+func (l *sceneLoader) build(n nodeJSON) (Node, error) {
+	if mode, ok := noiseTypes[n.Type]; ok {
+		if len(n.Scale) != 1 {
+			return nil, fmt.Errorf("%s node needs a single scale value", n.Type)
+		}
+		if n.Scale[0] == 0 {
+			return nil, fmt.Errorf("%s node needs a scale other than 0", n.Type)
+		}
+		ramp, err := l.ramp(n.Ramp)
+		if err != nil {
+			return nil, err
+		}
+		octaves := n.Octaves
+		if octaves <= 0 {
+			octaves = 4
+		}
+		if mode == NoiseMarble {
+			return getMarble(n.Scale[0], n.Distortion, octaves, ramp), nil
+		} else if mode == NoiseWood {
+			return getWood(n.Scale[0], n.Distortion, octaves, ramp), nil
+		}
+		return getNoise(mode, n.Scale[0], octaves, ramp), nil
+	}
+
+	switch n.Type {
+	case "constant":
+		c, err := l.color(n.Color)
+		if err != nil {
+			return nil, err
+		}
+		return getConstant(c), nil
+	case "checker", "checker_uv":
+		if len(n.Colors) != 2 {
+			return nil, fmt.Errorf("%s node needs 2 colors", n.Type)
+		}
+		c1, err := l.color(n.Colors[0])
+		if err != nil {
+			return nil, err
+		}
+		c2, err := l.color(n.Colors[1])
+		if err != nil {
+			return nil, err
+		}
+		if n.Type == "checker_uv" {
+			if len(n.Scale) != 2 {
+				return nil, fmt.Errorf("checker_uv node needs 2 scale values")
+			}
+			return getCheckerboardUV(c1, c2, n.Scale[0], n.Scale[1]), nil
+		}
+		scale, err := toTuple(n.Scale)
+		if err != nil {
+			return nil, err
+		}
+		return getCheckerboard(c1, c2, scale.x, scale.y, scale.z), nil
+	case "image":
+		texture, err := l.image(n.File, n.Linear)
+		if err != nil {
+			return nil, err
+		}
+		filter, ok := filterTypes[n.Filter]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %q", n.Filter)
+		}
+		wrap, ok := wrapTypes[n.Wrap]
+		if !ok {
+			return nil, fmt.Errorf("unknown wrap mode %q", n.Wrap)
+		}
+		return getImageUVFiltered(texture, filter, wrap, n.Mipmap), nil
+	case "add", "multiply":
+		inputs, err := l.inputs(n, 2)
+		if err != nil {
+			return nil, err
+		}
+		if n.Type == "add" {
+			return AddNode{inputs[0], inputs[1]}, nil
+		}
+		return MulNode{inputs[0], inputs[1]}, nil
+	case "mix":
+		inputs, err := l.inputs(n, 2)
+		if err != nil {
+			return nil, err
+		}
+		factor, err := l.dataNode(n.Factor)
+		if err != nil {
+			return nil, err
+		}
+		return MixNode{inputs[0], inputs[1], factor}, nil
+	case "invert":
+		inputs, err := l.inputs(n, 1)
+		if err != nil {
+			return nil, err
+		}
+		return InvertNode{inputs[0]}, nil
+	case "remap":
+		inputs, err := l.inputs(n, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(n.From) != 2 || len(n.To) != 2 {
+			return nil, fmt.Errorf("remap node needs from and to ranges")
+		}
+		if n.From[0] == n.From[1] {
+			return nil, fmt.Errorf("remap node needs a from range that is not empty")
+		}
+		return RemapNode{inputs[0], n.From[0], n.From[1], n.To[0], n.To[1]}, nil
+	case "ramp":
+		factor, err := l.dataNode(n.Factor)
+		if err != nil {
+			return nil, err
+		}
+		ramp, err := l.ramp(n.Ramp)
+		if err != nil {
+			return nil, err
+		}
+		return RampNode{factor, ramp}, nil
+	case "uv_transform":
+		inputs, err := l.inputs(n, 1)
+		if err != nil {
+			return nil, err
+		}
+		scale := []float64{1, 1}
+		offset := []float64{0, 0}
+		if n.Scale != nil {
+			scale = n.Scale
+		}
+		if n.Offset != nil {
+			offset = n.Offset
+		}
+		if len(scale) != 2 || len(offset) != 2 {
+			return nil, fmt.Errorf("uv_transform node needs 2 scale and offset values")
+		}
+		return UVTransformNode{inputs[0], scale[0], scale[1], offset[0], offset[1], n.Angle * math.Pi / 180}, nil
+	}
+	return nil, fmt.Errorf("unknown node type %q", n.Type)
+}
+
+// parameter parses a material parameter that is either a number or a texture graph
+func (l *sceneLoader) parameter(raw json.RawMessage, fallback float64) (float64, Node, error) {
+	if len(raw) == 0 {
+		return fallback, nil, nil
+	}
+	var value float64
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value, nil, nil
+	}
+	node, err := l.dataNode(raw)
+	return fallback, node, err
+}
+
+func (l *sceneLoader) material(m materialJSON) (Material, error) {
+	var material Material
+	var err error
+	kind, ok := materialTypes[m.Type]
+	if !ok {
+		return material, fmt.Errorf("unknown material type %q", m.Type)
+	}
+	material.material = kind
+	material.albedo = getConstant(Color{1, 1, 1})
+	if len(m.Albedo) != 0 {
+		if material.albedo, err = l.node(m.Albedo); err != nil {
+			return material, err
+		}
+	}
+	if material.roughness, material.maps.roughness, err = l.parameter(m.Roughness, 0); err != nil {
+		return material, err
+	}
+	if material.ior, material.maps.ior, err = l.parameter(m.Ior, 1.45); err != nil {
+		return material, err
+	}
+	if material.specularity, material.maps.specularity, err = l.parameter(m.Specularity, 0); err != nil {
+		return material, err
+	}
+	if len(m.Emission) != 0 {
+		if material.maps.emission, err = l.node(m.Emission); err != nil {
+			return material, err
+		}
+	}
+	if len(m.Normal) != 0 {
+		if material.maps.normal, err = l.dataNode(m.Normal); err != nil {
+			return material, err
+		}
+	}
+	if len(m.Bump) != 0 {
+		if material.maps.bump, err = l.dataNode(m.Bump); err != nil {
+			return material, err
+		}
+		material.maps.bumpStrength = m.BumpStrength
+	}
+	material.emitter = Emitter{1, m.Temperature, true, m.Normalize}
+	if m.Strength != nil {
+		material.emitter.strength = *m.Strength
+	}
+	if m.TwoSided != nil {
+		material.emitter.twoSided = *m.TwoSided
+	}
+	if material.animation, err = materialKeys(m, material); err != nil {
+		return material, err
+	}
+	if len(material.animation) == 0 {
+		material.animation = nil
+	}
+	return material, nil
+}
+
+// cameraKeys parses keys of an animated camera, missing values are taken from the camera itself
+func cameraKeys(c cameraJSON, base CameraKey) ([]CameraKey, error) {
+	keys := []CameraKey{}
+	for _, key := range c.Motion {
+		k := base
+		k.time = key.Time
+		var err error
+		if key.From != nil {
+			if k.from, err = toTuple(key.From); err != nil {
+				return nil, err
+			}
+		}
+		if key.At != nil {
+			if k.at, err = toTuple(key.At); err != nil {
+				return nil, err
+			}
+		}
+		if key.Up != nil {
+			if k.up, err = toTuple(key.Up); err != nil {
+				return nil, err
+			}
+		}
+		if key.Fov != nil {
+			k.fov = *key.Fov
+		}
+		if key.FocalLength != nil {
+			k.focalLength = *key.FocalLength
+		}
+		if key.Aperture != nil {
+			k.aperture = *key.Aperture
+		}
+		if key.FNumber != nil {
+			k.fNumber = *key.FNumber
+		}
+		if key.Focus != nil {
+			k.focus = *key.Focus
+		}
+		if k.interpolation, err = interpolation(key.Interpolation); err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 && k.time <= keys[len(keys)-1].time {
+			return nil, fmt.Errorf("camera keys must be sorted by time")
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// camera builds camera of the scene, moving cameras are built again for every ray
+func (l *sceneLoader) camera(c cameraJSON) (Camera, error) {
+	from, err := toTuple(c.From)
+	if err != nil {
+		return nil, err
+	}
+	at, err := toTuple(c.At)
+	if err != nil {
+		return nil, err
+	}
+	up := Tuple{0, 1, 0, 0}
+	if c.Up != nil {
+		if up, err = toTuple(c.Up); err != nil {
+			return nil, err
+		}
+	}
+
+	aspect := float64(hsize) / float64(vsize)
+	var build func(k CameraKey) Camera
+	switch c.Type {
+	case "", "perspective":
+		sensorWidth := c.SensorWidth
+		if sensorWidth == 0 {
+			sensorWidth = 36
+		}
+		bokeh := Bokeh{}
+		if c.Bokeh != "" {
+			texture, err := l.image(c.Bokeh, true)
+			if err != nil {
+				return nil, err
+			}
+			bokeh = getImageBokeh(texture)
+		} else if c.Blades > 0 {
+			bokeh = getPolygonBokeh(c.Blades, c.BladeRotation*math.Pi/180)
+		}
+		build = func(k CameraKey) Camera {
+			focus := k.focus
+			if focus == 0 {
+				focus = k.at.Subtract(k.from).Magnitude()
+			}
+			if c.FocalLength == 0 {
+				return getCamera(k.from, k.at, k.up, k.fov, aspect, k.aperture, focus)
+			}
+			return getPhysicalCamera(k.from, k.at, k.up, k.focalLength, sensorWidth, k.fNumber, aspect, focus, bokeh)
+		}
+	case "orthographic":
+		build = func(k CameraKey) Camera {
+			return getOrthographicCamera(k.from, k.at, k.up, c.Height, aspect)
+		}
+	case "fisheye":
+		build = func(k CameraKey) Camera {
+			return getFisheyeCamera(k.from, k.at, k.up, k.fov, aspect)
+		}
+	case "equirectangular":
+		ipd := c.Ipd
+		if ipd == 0 {
+			ipd = 0.064
+		}
+		build = func(k CameraKey) Camera {
+			return getEquirectangularCamera(k.from, k.at, k.up, c.Stereo, ipd)
+		}
+	default:
+		return nil, fmt.Errorf("unknown camera type %q", c.Type)
+	}
+
+	base := CameraKey{0, from, at, up, c.Fov, c.FocalLength, c.Aperture, c.FNumber, c.Focus, LinearInterpolation}
+	keys, err := cameraKeys(c, base)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		return MotionCamera{keys, build}, nil
+	}
+	return build(base), nil
+}
+
+// materialKeys parses animated parameters of a material, missing values are taken from the material itself
+func materialKeys(m materialJSON, material Material) ([]MaterialKey, error) {
+	keys := []MaterialKey{}
+	for _, key := range m.Animation {
+		k := MaterialKey{key.Time, material.roughness, material.ior, material.specularity, material.emitter.strength, material.emitter.temperature, LinearInterpolation}
+		if key.Roughness != nil {
+			k.roughness = *key.Roughness
+		}
+		if key.Ior != nil {
+			k.ior = *key.Ior
+		}
+		if key.Specularity != nil {
+			k.specularity = *key.Specularity
+		}
+		if key.Strength != nil {
+			k.strength = *key.Strength
+		}
+		if key.Temperature != nil {
+			k.temperature = *key.Temperature
+		}
+		var err error
+		if k.interpolation, err = interpolation(key.Interpolation); err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 && k.time <= keys[len(keys)-1].time {
+			return nil, fmt.Errorf("material keys must be sorted by time")
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// transformKeys parses keyframed transformation of an object
+func transformKeys(transform []transformJSON) ([]TransformKey, error) {
+	keys := []TransformKey{}
+	for _, key := range transform {
+		k := TransformKey{key.Time, Tuple{0, 0, 0, 0}, Tuple{0, 0, 0, 0}, Tuple{1, 1, 1, 0}, LinearInterpolation}
+		var err error
+		if k.interpolation, err = interpolation(key.Interpolation); err != nil {
+			return nil, err
+		}
+		if key.Translate != nil {
+			if k.translation, err = toTuple(key.Translate); err != nil {
+				return nil, err
+			}
+		}
+		if key.Rotate != nil {
+			if k.rotation, err = toTuple(key.Rotate); err != nil {
+				return nil, err
+			}
+			k.rotation = k.rotation.MulScalar(math.Pi / 180)
+		}
+		if key.Scale != nil {
+			if k.scale, err = toTuple(key.Scale); err != nil {
+				return nil, err
+			}
+		}
+		if len(keys) > 0 && k.time <= keys[len(keys)-1].time {
+			return nil, fmt.Errorf("transform keys must be sorted by time")
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// loadScene reads scene description from a JSON file
+func loadScene(path string) (Scene, error) {
+	var scene Scene
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return scene, err
+	}
+	var description sceneJSON
+	if err := json.Unmarshal(data, &description); err != nil {
+		return scene, fmt.Errorf("%s: %v", path, err)
+	}
+	scene.files = []string{path}
+
+	working, ok := workingSpaces[description.Color.Working]
+	if !ok {
+		return scene, fmt.Errorf("unknown working color space %q", description.Color.Working)
+	}
+	display, ok := displayEncodings[description.Color.Display]
+	if !ok {
+		return scene, fmt.Errorf("unknown display encoding %q", description.Color.Display)
+	}
+	// textures are converted into the working space while loading
+	scene.color = ColorConfig{working, display}
+
+	loader := sceneLoader{description.Textures, map[string]Node{}, map[string]bool{}, map[string][][]Color{}, false, nil, scene.color}
+	materials := map[string]Material{}
+	// IDs of materials follow sorted names, so that they do not change between runs
+	names := make([]string, 0, len(description.Materials))
+	for name := range description.Materials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for id, name := range names {
+		material, err := loader.material(description.Materials[name])
+		if err != nil {
+			return scene, fmt.Errorf("material %q: %v", name, err)
+		}
+		material.id = id + 1
+		materials[name] = material
+	}
+
+	for i, object := range description.Objects {
+		material, ok := materials[object.Material]
+		if !ok {
+			return scene, fmt.Errorf("object %d: unknown material %q", i, object.Material)
+		}
+		material.object = i + 1
+		keys, err := transformKeys(object.Transform)
+		if err != nil {
+			return scene, fmt.Errorf("object %d: %v", i, err)
+		}
+		// transformed objects are kept in local space of their own instance, so their emitters are normalized once they are placed
+		spheres := &scene.spheres
+		triangles := &scene.triangles
+		local := material
+		if len(keys) > 0 {
+			spheres = &[]Sphere{}
+			triangles = &[]Triangle{}
+			local.emitter.normalize = false
+		}
+		switch object.Type {
+		case "sphere":
+			center, err := toTuple(object.Center)
+			if err != nil {
+				return scene, fmt.Errorf("object %d: %v", i, err)
+			}
+			sphere := Sphere{center, object.Radius, local}
+			sphere.material = local.normalizeEmission(sphere.area())
+			*spheres = append(*spheres, sphere)
+		case "obj":
+			file, err := os.Open(object.File)
+			if err != nil {
+				return scene, fmt.Errorf("object %d: %v", i, err)
+			}
+			loadOBJ(file, triangles, local, object.Smooth)
+			scene.files = append(scene.files, object.File)
+		default:
+			return scene, fmt.Errorf("object %d: unknown type %q", i, object.Type)
+		}
+		if len(keys) > 0 {
+			if material.material == Emission && material.emitter.normalize {
+				// the area is taken at the first key, so that scaling the object keeps its power
+				area := 0.0
+				for _, s := range *spheres {
+					area += keys[0].sphereArea(s)
+				}
+				for _, t := range *triangles {
+					area += keys[0].triangleArea(t)
+				}
+				for j := range *spheres {
+					(*spheres)[j].material = material.normalizeEmission(area)
+				}
+				for j := range *triangles {
+					(*triangles)[j].material = material.normalizeEmission(area)
+				}
+			}
+			scene.instances = append(scene.instances, getInstance(*spheres, *triangles, keys))
+		}
+	}
+
+	if a := description.Animation; a != nil {
+		if a.Fps <= 0 || a.End < a.Start {
+			return scene, fmt.Errorf("animation needs fps and a range of frames")
+		}
+		scene.animation = &Animation{a.Start, a.End, a.Fps}
+	}
+
+	if description.Shutter != nil {
+		if len(description.Shutter) != 2 || description.Shutter[1] < description.Shutter[0] {
+			return scene, fmt.Errorf("shutter needs open and close time")
+		}
+		scene.shutter = [2]float64{description.Shutter[0], description.Shutter[1]}
+	}
+
+	c := description.Camera
+	if scene.camera, err = loader.camera(c); err != nil {
+		return scene, fmt.Errorf("camera: %v", err)
+	}
+	if c.Autofocus != nil {
+		if len(c.Autofocus) != 2 {
+			return scene, fmt.Errorf("camera: autofocus needs x and y of a pixel")
+		} else if c.Type != "" && c.Type != "perspective" {
+			return scene, fmt.Errorf("camera: autofocus needs a perspective camera, not %s", c.Type)
+		}
+		scene.autofocus = c.Autofocus
+	}
+	scene.files = append(scene.files, loader.files...)
+
+	return scene, nil
+}
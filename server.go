@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// previewRefresh is the number of seconds between refreshes of the preview page
+const previewRefresh = 2
+
+// Server serves previews and progress of the frame being rendered over HTTP and lets the render be paused, resumed, stopped or saved
+type Server struct {
+	renderer *Renderer
+	config   ColorConfig
+	tone     ToneMap
+	chain    []Effect
+
+	mutex    sync.Mutex
+	frame    int
+	snapshot func() string // saves the current image of the frame and returns its name
+}
+
+// serverStats is the progress of the frame sent as JSON
+type serverStats struct {
+	Frame   int     `json:"frame"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Samples int     `json:"samples"` // target number of samples of every pixel
+	Done    int64   `json:"done"`    // traced samples of the frame
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent"`
+	Rate    float64 `json:"rate"` // samples per second
+	Elapsed float64 `json:"elapsed"`
+	ETA     float64 `json:"eta"`
+	Paused  bool    `json:"paused"`
+	Stopped bool    `json:"stopped"`
+}
+
+func getServer(renderer *Renderer, config ColorConfig, tone ToneMap, chain []Effect) *Server {
+	return &Server{renderer, config, tone, chain, sync.Mutex{}, 0, nil}
+}
+
+// setFrame makes snapshots save images of the frame
+func (s *Server) setFrame(frame int, snapshot func() string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.frame, s.snapshot = frame, snapshot
+}
+
+// listen starts serving on the address, errors of the address are returned before the render starts
+func (s *Server) listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.page)
+	mux.HandleFunc("/image.png", s.image)
+	mux.HandleFunc("/stats", s.stats)
+	mux.HandleFunc("/pause", s.control(func() string { s.renderer.pause(true); return "paused" }))
+	mux.HandleFunc("/resume", s.control(func() string { s.renderer.pause(false); return "resumed" }))
+	mux.HandleFunc("/stop", s.control(func() string { s.renderer.stop(); return "stopping" }))
+	mux.HandleFunc("/snapshot", s.control(func() string {
+		s.mutex.Lock()
+		snapshot := s.snapshot
+		s.mutex.Unlock()
+		if snapshot == nil {
+			return "nothing to save yet"
+		}
+		return "saved " + snapshot()
+	}))
+	go func() {
+		log.Println(http.Serve(listener, mux))
+	}()
+	log.Printf("Serving previews at http://%s/\n", listener.Addr())
+	if tcp, ok := listener.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+		log.Println("Warning: anyone who can reach the address can stop and control the render, serve at localhost to keep it private")
+	}
+	return nil
+}
+
+// image writes the current average of the film after post effects, tone mapped for the display
+func (s *Server) image(w http.ResponseWriter, r *http.Request) {
+	film, _ := s.renderer.current()
+	if film == nil {
+		http.Error(w, "rendering has not started yet", http.StatusServiceUnavailable)
+		return
+	}
+	canvas := applyEffects(film.resolve(), film.width, film.height, s.chain, film.seed, s.config)
+	for i := range canvas {
+		canvas[i] = s.config.encode(canvas[i], s.tone)
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	png.Encode(w, rgbaImage(canvas, film.width, film.height))
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	film, progress := s.renderer.current()
+	s.mutex.Lock()
+	stats := serverStats{Frame: s.frame, Samples: s.renderer.settings.samples}
+	s.mutex.Unlock()
+	stats.Paused, stats.Stopped = s.renderer.isPaused(), s.renderer.isStopped()
+	if film != nil {
+		stats.Width, stats.Height = film.width, film.height
+		stats.Done, stats.Total = atomic.LoadInt64(&progress.done), progress.total
+		progress.mutex.Lock()
+		percent, eta := progress.estimate(stats.Done)
+		stats.Rate = progress.rate
+		progress.mutex.Unlock()
+		stats.Percent, stats.ETA = percent, eta.Seconds()
+		stats.Elapsed = time.Since(progress.start).Seconds()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// control returns handler of an action, which changes state of the render and so has to be posted
+func (s *Server) control(action func() string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		message := action()
+		log.Printf("%s from %s\n", message, r.RemoteAddr)
+		fmt.Fprintln(w, message)
+	}
+}
+
+func (s *Server) page(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, previewPage, previewRefresh*1000)
+}
+
+// previewPage reloads the image and the stats periodically, buttons post actions
+const previewPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>go-pt</title>
+<style>
+body { background: #222; color: #ddd; font-family: sans-serif; }
+img { max-width: 100%%; image-rendering: pixelated; }
+button { margin-right: 0.5em; }
+</style>
+</head>
+<body>
+<p><img id="image" src="/image.png"></p>
+<p id="stats"></p>
+<p>
+<button onclick="post('pause')">Pause</button><button onclick="post('resume')">Resume</button><button onclick="post('snapshot')">Snapshot</button><button onclick="if (confirm('Stop the render?')) post('stop')">Stop</button>
+<span id="message"></span>
+</p>
+<script>
+function duration(s) {
+	s = Math.round(s);
+	return Math.floor(s / 3600) + "h " + Math.floor(s / 60) %% 60 + "m " + s %% 60 + "s";
+}
+function post(action) {
+	fetch("/" + action, {method: "POST"}).then(r => r.text()).then(t => document.getElementById("message").textContent = t);
+}
+function refresh() {
+	fetch("/stats").then(r => r.json()).then(s => {
+		let state = s.stopped ? "stopped" : s.paused ? "paused" : "rendering";
+		document.getElementById("stats").textContent = "Frame " + s.frame + ", " + s.width + "x" + s.height + " at " + s.samples + " samples, " + state + ", " +
+			s.percent.toFixed(2) + "%%, " + (s.rate / 1e6).toFixed(3) + " Msamples/s, " + duration(s.elapsed) + " elapsed, ETA " + duration(s.eta);
+	});
+	document.getElementById("image").src = "/image.png?" + Date.now();
+}
+refresh();
+setInterval(refresh, %d);
+</script>
+</body>
+</html>
+`
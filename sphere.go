@@ -1,7 +1,14 @@
 package main
 
+import "math"
+
 type Sphere struct {
 	origin   Tuple
 	radius   float64
 	material Material
 }
+
+// area returns surface area of the sphere
+func (s Sphere) area() float64 {
+	return 4 * math.Pi * s.radius * s.radius
+}
@@ -9,6 +9,27 @@ const (
 	Checkerboard
 	CheckerboardUV
 	ImageUV
+	NoisePerlin
+	NoiseSimplex
+	NoiseFBM
+	NoiseTurbulence
+	NoiseVoronoi
+	NoiseMarble
+	NoiseWood
+)
+
+// texture filtering modes
+const (
+	Nearest = iota
+	Bilinear
+	Bicubic
+)
+
+// texture wrapping modes
+const (
+	Clamp = iota
+	Repeat
+	Mirror
 )
 
 type Texture struct {
@@ -16,25 +37,237 @@ type Texture struct {
 	scaleX, scaleY, scaleZ float64
 	mode                   int
 	texture                [][]Color
+	filter, wrap           int
+	mips                   [][][]Color
+	noise                  Noise
+}
+
+// Noise holds parameters of procedural noise textures
+type Noise struct {
+	octaves          int
+	lacunarity, gain float64
+	distortion       float64 // strength of turbulence in marble and wood
+	ramp             []RampStop
+}
+
+// RampStop maps value at position to a texture node, constant color stops use getConstant
+type RampStop struct {
+	position float64
+	texture  Node
+}
+
+// getRamp returns color ramp with colors placed at given positions
+func getRamp(positions []float64, colors []Color) []RampStop {
+	ramp := make([]RampStop, len(positions))
+	for i := range positions {
+		ramp[i] = RampStop{positions[i], getConstant(colors[i])}
+	}
+	return ramp
 }
 
 func getConstant(c Color) Texture {
-	return Texture{[]Color{c}, 0, 0, 0, Constant, nil}
+	return Texture{[]Color{c}, 0, 0, 0, Constant, nil, Nearest, Clamp, nil, Noise{}}
 }
 
 func getCheckerboard(c1, c2 Color, scaleX, scaleY, scaleZ float64) Texture {
-	return Texture{[]Color{c1, c2}, scaleX, scaleY, scaleZ, Checkerboard, nil}
+	return Texture{[]Color{c1, c2}, scaleX, scaleY, scaleZ, Checkerboard, nil, Nearest, Clamp, nil, Noise{}}
 }
 
 func getCheckerboardUV(c1, c2 Color, scaleU, scaleV float64) Texture {
-	return Texture{[]Color{c1, c2}, scaleU, scaleV, 0, CheckerboardUV, nil}
+	return Texture{[]Color{c1, c2}, scaleU, scaleV, 0, CheckerboardUV, nil, Nearest, Clamp, nil, Noise{}}
 }
 
 func getImageUV(texture [][]Color) Texture {
-	return Texture{nil, 0, 0, 0, ImageUV, texture}
+	return Texture{nil, 0, 0, 0, ImageUV, texture, Nearest, Clamp, nil, Noise{}}
+}
+
+// getNoise returns solid noise texture, scale is the size of a noise cell in world units
+func getNoise(mode int, scale float64, octaves int, ramp []RampStop) Texture {
+	return Texture{nil, scale, scale, scale, mode, nil, Nearest, Clamp, nil, Noise{octaves, 2, 0.5, 0, ramp}}
+}
+
+// getMarble returns marble texture with veins along the x axis
+func getMarble(scale, distortion float64, octaves int, ramp []RampStop) Texture {
+	return Texture{nil, scale, scale, scale, NoiseMarble, nil, Nearest, Clamp, nil, Noise{octaves, 2, 0.5, distortion, ramp}}
+}
+
+// getWood returns wood texture with rings around the y axis
+func getWood(scale, distortion float64, octaves int, ramp []RampStop) Texture {
+	return Texture{nil, scale, scale, scale, NoiseWood, nil, Nearest, Clamp, nil, Noise{octaves, 2, 0.5, distortion, ramp}}
+}
+
+// getImageUVFiltered returns image texture with given filtering and wrapping, optionally with a mip pyramid
+func getImageUVFiltered(texture [][]Color, filter, wrap int, mipmap bool) Texture {
+	t := Texture{nil, 0, 0, 0, ImageUV, texture, filter, wrap, nil, Noise{}}
+	if mipmap {
+		t.mips = buildMips(texture)
+	}
+	return t
+}
+
+// buildMips returns the image followed by its downsampled versions down to 1x1 texel
+func buildMips(texture [][]Color) [][][]Color {
+	mips := [][][]Color{texture}
+	level := texture
+	for len(level) > 1 || len(level[0]) > 1 {
+		width := len(level)
+		height := len(level[0])
+		nw := int(math.Max(1, float64(width/2)))
+		nh := int(math.Max(1, float64(height/2)))
+		next := make([][]Color, nw)
+		for x := 0; x < nw; x++ {
+			next[x] = make([]Color, nh)
+			x0 := 2 * x
+			x1 := int(math.Min(float64(x0+1), float64(width-1)))
+			for y := 0; y < nh; y++ {
+				y0 := 2 * y
+				y1 := int(math.Min(float64(y0+1), float64(height-1)))
+				next[x][y] = level[x0][y0].Add(level[x1][y0]).Add(level[x0][y1]).Add(level[x1][y1]).MulScalar(0.25)
+			}
+		}
+		mips = append(mips, next)
+		level = next
+	}
+	return mips
+}
+
+// wrapIndex maps texel index into [0, n) using wrapping mode
+func wrapIndex(i, n, wrap int) int {
+	if wrap == Repeat {
+		i %= n
+		if i < 0 {
+			i += n
+		}
+		return i
+	} else if wrap == Mirror {
+		period := 2 * n
+		i %= period
+		if i < 0 {
+			i += period
+		}
+		if i >= n {
+			i = period - 1 - i
+		}
+		return i
+	}
+	if i < 0 {
+		return 0
+	}
+	if i > n-1 {
+		return n - 1
+	}
+	return i
+}
+
+func (t Texture) texel(level [][]Color, x, y int) Color {
+	return level[wrapIndex(x, len(level), t.wrap)][wrapIndex(y, len(level[0]), t.wrap)]
+}
+
+// catmullRom returns weights of four neighbouring texels for fractional offset f
+func catmullRom(f float64) [4]float64 {
+	f2 := f * f
+	f3 := f2 * f
+	return [4]float64{
+		0.5 * (-f3 + 2*f2 - f),
+		0.5 * (3*f3 - 5*f2 + 2),
+		0.5 * (-3*f3 + 4*f2 + f),
+		0.5 * (f3 - f2),
+	}
+}
+
+// sample looks up single mip level using texture's filter
+func (t Texture) sample(level [][]Color, u, v float64) Color {
+	x := u * float64(len(level))
+	y := v * float64(len(level[0]))
+	if t.filter == Bilinear {
+		x -= 0.5
+		y -= 0.5
+		x0 := math.Floor(x)
+		y0 := math.Floor(y)
+		fx := x - x0
+		fy := y - y0
+		i := int(x0)
+		j := int(y0)
+		top := t.texel(level, i, j).MulScalar(1 - fx).Add(t.texel(level, i+1, j).MulScalar(fx))
+		bottom := t.texel(level, i, j+1).MulScalar(1 - fx).Add(t.texel(level, i+1, j+1).MulScalar(fx))
+		return top.MulScalar(1 - fy).Add(bottom.MulScalar(fy))
+	} else if t.filter == Bicubic {
+		x -= 0.5
+		y -= 0.5
+		x0 := math.Floor(x)
+		y0 := math.Floor(y)
+		wx := catmullRom(x - x0)
+		wy := catmullRom(y - y0)
+		result := Color{0, 0, 0}
+		for m := 0; m < 4; m++ {
+			row := Color{0, 0, 0}
+			for n := 0; n < 4; n++ {
+				row = row.Add(t.texel(level, int(x0)+n-1, int(y0)+m-1).MulScalar(wx[n]))
+			}
+			result = result.Add(row.MulScalar(wy[m]))
+		}
+		// negative lobes of the filter can overshoot below zero
+		return Color{math.Max(0, result.r), math.Max(0, result.g), math.Max(0, result.b)}
+	}
+	return t.texel(level, int(math.Floor(x)), int(math.Floor(y)))
 }
 
-func (t Texture) color(u, v float64, p Tuple) Color {
+// lod returns mip level matching the footprint of the ray at hit point
+func (t Texture) lod(rec HitRecord) float64 {
+	size := math.Max(float64(len(t.texture)), float64(len(t.texture[0])))
+	texels := rec.footprint * rec.uvScale * size
+	if texels <= 1 {
+		return 0
+	}
+	return math.Min(math.Log2(texels), float64(len(t.mips)-1))
+}
+
+// noiseValue returns value of the noise texture at point p in range [0, 1]
+func (t Texture) noiseValue(p Tuple) float64 {
+	p = Tuple{p.x / t.scaleX, p.y / t.scaleY, p.z / t.scaleZ, 0}
+	n := t.noise
+	value := 0.0
+	if t.mode == NoisePerlin {
+		value = 0.5 + 0.5*Perlin(p)
+	} else if t.mode == NoiseSimplex {
+		value = 0.5 + 0.5*Simplex(p)
+	} else if t.mode == NoiseFBM {
+		value = 0.5 + 0.5*FBM(p, n.octaves, n.lacunarity, n.gain)
+	} else if t.mode == NoiseTurbulence {
+		value = Turbulence(p, n.octaves, n.lacunarity, n.gain)
+	} else if t.mode == NoiseVoronoi {
+		value, _ = Worley(p)
+	} else if t.mode == NoiseMarble {
+		value = 0.5 + 0.5*math.Sin((p.x+n.distortion*Turbulence(p, n.octaves, n.lacunarity, n.gain))*math.Pi)
+	} else if t.mode == NoiseWood {
+		rings := math.Sqrt(p.x*p.x+p.z*p.z) + n.distortion*FBM(p, n.octaves, n.lacunarity, n.gain)
+		value = rings - math.Floor(rings)
+	}
+	return math.Max(0, math.Min(1, value))
+}
+
+// evalRamp maps value in range [0, 1] to color using color ramp, empty ramp returns grayscale value
+func evalRamp(stops []RampStop, value float64, rec HitRecord) Color {
+	if len(stops) == 0 {
+		return Color{value, value, value}
+	}
+	if value <= stops[0].position {
+		return stops[0].texture.color(rec)
+	}
+	for i := 1; i < len(stops); i++ {
+		if value <= stops[i].position {
+			if stops[i].position <= stops[i-1].position {
+				return stops[i].texture.color(rec)
+			}
+			f := (value - stops[i-1].position) / (stops[i].position - stops[i-1].position)
+			return stops[i-1].texture.color(rec).MulScalar(1 - f).Add(stops[i].texture.color(rec).MulScalar(f))
+		}
+	}
+	return stops[len(stops)-1].texture.color(rec)
+}
+
+func (t Texture) color(rec HitRecord) Color {
+	u, v, p := rec.u, rec.v, rec.p
 	if t.mode == Constant {
 		return t.c[0]
 	} else if t.mode == Checkerboard {
@@ -48,23 +281,20 @@ func (t Texture) color(u, v float64, p Tuple) Color {
 		}
 		return t.c[1]
 	} else if t.mode == ImageUV {
-		nx := float64(len(t.texture))
-		ny := float64(len(t.texture[0]))
-		i := u * nx
-		j := v*ny - 0.001
-		if i < 0 {
-			i = 0
-		}
-		if j < 0 {
-			j = 0
-		}
-		if i > nx-1 {
-			i = nx - 1
+		if t.mips == nil {
+			return t.sample(t.texture, u, v)
 		}
-		if j > ny-1 {
-			j = ny - 1
+		// trilinear blend of the two closest mip levels
+		lod := t.lod(rec)
+		level := int(math.Floor(lod))
+		f := lod - float64(level)
+		c := t.sample(t.mips[level], u, v)
+		if f > 0 && level+1 < len(t.mips) {
+			c = c.MulScalar(1 - f).Add(t.sample(t.mips[level+1], u, v).MulScalar(f))
 		}
-		return t.texture[int(i)][int(j)]
+		return c
+	} else if t.mode >= NoisePerlin && t.mode <= NoiseWood {
+		return evalRamp(t.noise.ramp, t.noiseValue(p), rec)
 	}
 	return Color{}
 }
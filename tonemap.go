@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// tone mapping operators
+const (
+	ClampToneMap = iota
+	ReinhardToneMap
+	ExtendedReinhardToneMap
+	HableToneMap
+	ACESToneMap
+	AgXToneMap
+)
+
+// ToneMap maps linear sRGB colors of an output into the range of the display
+type ToneMap struct {
+	operator    int
+	exposure    float64 // in stops
+	temperature float64 // color temperature in Kelvin of light that should look white, 0 disables white balance
+	white       float64 // luminance mapped to white by extended Reinhard
+	balance     [3][3]float64
+}
+
+// white balance is limited to temperatures of real light sources
+const minTemperature, maxTemperature = 1000, 40000
+
+// toneOutputs are outputs with their own tone mapping, light AOVs are tone mapped like the beauty image
+var toneOutputs = []string{"beauty", "denoised", "preview"}
+
+func getToneMap(operator int, exposure, temperature, white float64) ToneMap {
+	t := ToneMap{operator, exposure, temperature, white, [3][3]float64{}}
+	if temperature > 0 {
+		t.balance = whiteBalance(temperature)
+	}
+	return t
+}
+
+// outputValue returns the value of a flag like aces,preview:clamp for an output, values without an output are the default
+func outputValue(value, output string) (string, error) {
+	fallback, own := "", ""
+	for _, item := range strings.Split(value, ",") {
+		name, v, found := strings.Cut(strings.TrimSpace(item), ":")
+		if !found {
+			fallback = name
+			continue
+		}
+		known := false
+		for _, o := range toneOutputs {
+			known = known || o == name
+		}
+		if !known {
+			return "", fmt.Errorf("unknown output %q, expected %s", name, strings.Join(toneOutputs, ", "))
+		}
+		if name == output {
+			own = v
+		}
+	}
+	if own != "" {
+		return own, nil
+	}
+	return fallback, nil
+}
+
+// getToneMaps returns tone mapping of every output from values of the tone mapping flags
+func getToneMaps(operator, exposure, temperature, white string) (map[string]ToneMap, error) {
+	tones := map[string]ToneMap{}
+	for _, output := range toneOutputs {
+		name, err := outputValue(operator, output)
+		if err != nil {
+			return nil, err
+		}
+		kind, ok := toneMaps[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tone mapping %q", name)
+		}
+		var values [3]float64
+		for i, flag := range []string{exposure, temperature, white} {
+			v, err := outputValue(flag, output)
+			if err != nil {
+				return nil, err
+			}
+			if values[i], err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("tone mapping of %s: %v", output, err)
+			}
+		}
+		if values[1] != 0 && (values[1] < minTemperature || values[1] > maxTemperature) {
+			return nil, fmt.Errorf("white balance of %s must be between %dK and %dK", output, minTemperature, maxTemperature)
+		}
+		tones[output] = getToneMap(kind, values[0], values[1], values[2])
+	}
+	return tones, nil
+}
+
+// linear sRGB to XYZ and back
+var srgbToXYZ = [3][3]float64{
+	{0.4124564, 0.3575761, 0.1804375},
+	{0.2126729, 0.7151522, 0.0721750},
+	{0.0193339, 0.1191920, 0.9503041},
+}
+
+var xyzToSRGB = [3][3]float64{
+	{3.2404542, -1.5371385, -0.4985314},
+	{-0.9692660, 1.8760108, 0.0415560},
+	{0.0556434, -0.2040259, 1.0572252},
+}
+
+// Bradford cone response and its inverse
+var bradford = [3][3]float64{
+	{0.8951, 0.2664, -0.1614},
+	{-0.7502, 1.7135, 0.0367},
+	{0.0389, -0.0685, 1.0296},
+}
+
+var bradfordInverse = [3][3]float64{
+	{0.9869929, -0.1470543, 0.1599627},
+	{0.4323053, 0.5183603, 0.0492912},
+	{-0.0085287, 0.0400428, 0.9684867},
+}
+
+// ACES fitted by Stephen Hill, input matrix from sRGB to the RRT space and output matrix from the ODT space to sRGB
+var acesInput = [3][3]float64{
+	{0.59719, 0.35458, 0.04823},
+	{0.07600, 0.90834, 0.01566},
+	{0.02840, 0.13383, 0.83777},
+}
+
+var acesOutput = [3][3]float64{
+	{1.60475, -0.53108, -0.07367},
+	{-0.10208, 1.10813, -0.00605},
+	{-0.00327, -0.07276, 1.07602},
+}
+
+// AgX matrices in Rec.2020 as used by Blender and Filament
+var srgbToRec2020 = [3][3]float64{
+	{0.6274, 0.3293, 0.0433},
+	{0.0691, 0.9195, 0.0113},
+	{0.0164, 0.0880, 0.8956},
+}
+
+var rec2020ToSRGB = [3][3]float64{
+	{1.6605, -0.5876, -0.0728},
+	{-0.1246, 1.1329, -0.0083},
+	{-0.0182, -0.1006, 1.1187},
+}
+
+var agxInset = [3][3]float64{
+	{0.856627153315983, 0.0951212405381588, 0.0482516061458583},
+	{0.137318972929847, 0.761241990602591, 0.101439036467562},
+	{0.11189821299995, 0.0767994186031903, 0.811302368396859},
+}
+
+var agxOutset = [3][3]float64{
+	{1.1271005818144368, -0.11060664309660323, -0.016493938717834573},
+	{-0.1413297634984383, 1.157823702216272, -0.016493938717834257},
+	{-0.14132976349843826, -0.11060664309660294, 1.2519364065950405},
+}
+
+// whiteBalance returns matrix of linear sRGB with gains in the cone space of Bradford, which make a blackbody at temperature look like one at 6500K
+func whiteBalance(temperature float64) [3][3]float64 {
+	source := mulMatrix(bradford, mulMatrix(srgbToXYZ, Blackbody(temperature)))
+	target := mulMatrix(bradford, mulMatrix(srgbToXYZ, Blackbody(6500)))
+	var m [3][3]float64
+	if source.r < 1e-6 || source.g < 1e-6 || source.b < 1e-6 {
+		// light too dim to balance is kept as it is
+		m[0][0], m[1][1], m[2][2] = 1, 1, 1
+		return m
+	}
+	gains := Color{target.r / source.r, target.g / source.g, target.b / source.b}
+	for j, c := range []Color{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}} {
+		c = mulMatrix(xyzToSRGB, mulMatrix(bradfordInverse, mulMatrix(bradford, mulMatrix(srgbToXYZ, c)).Mul(gains)))
+		m[0][j], m[1][j], m[2][j] = c.r, c.g, c.b
+	}
+	return m
+}
+
+// apply exposes and white balances linear sRGB color and maps it into range [0, 1], though clamping is left to the encoding
+func (t ToneMap) apply(c Color) Color {
+	c = c.MulScalar(math.Exp2(t.exposure))
+	if t.temperature > 0 {
+		c = mulMatrix(t.balance, c)
+	}
+	if t.operator == ReinhardToneMap || t.operator == ExtendedReinhardToneMap {
+		// luminance is mapped instead of channels, so that bright colors keep their hue
+		l := 0.2126729*c.r + 0.7151522*c.g + 0.0721750*c.b
+		if l <= 0 {
+			return Color{0, 0, 0}
+		}
+		mapped := l / (1 + l)
+		if t.operator == ExtendedReinhardToneMap && t.white > 0 {
+			mapped = l * (1 + l/(t.white*t.white)) / (1 + l)
+		}
+		return c.MulScalar(mapped / l)
+	} else if t.operator == HableToneMap {
+		const exposureBias, whitePoint = 2.0, 11.2
+		scale := 1 / hable(whitePoint)
+		return Color{hable(c.r*exposureBias) * scale, hable(c.g*exposureBias) * scale, hable(c.b*exposureBias) * scale}
+	} else if t.operator == ACESToneMap {
+		c = mulMatrix(acesInput, c)
+		c = Color{acesFit(c.r), acesFit(c.g), acesFit(c.b)}
+		return mulMatrix(acesOutput, c)
+	} else if t.operator == AgXToneMap {
+		return agx(c)
+	}
+	return c
+}
+
+// hable is the filmic curve of Uncharted 2 by John Hable
+func hable(x float64) float64 {
+	const a, b, c, d, e, f = 0.15, 0.50, 0.10, 0.20, 0.02, 0.30
+	return (x*(a*x+c*b)+d*e)/(x*(a*x+b)+d*f) - e/f
+}
+
+// acesFit approximates the reference rendering and output device transforms of ACES
+func acesFit(v float64) float64 {
+	a := v*(v+0.0245786) - 0.000090537
+	b := v*(0.983729*v+0.4329510) + 0.238081
+	return a / b
+}
+
+// agx maps color with the base look of AgX by Troy Sobotka, log encoded values in the inset space go through a sigmoid
+func agx(c Color) Color {
+	const minEV, maxEV = -12.47393, 4.026069
+	c = mulMatrix(agxInset, mulMatrix(srgbToRec2020, c))
+	curve := func(v float64) float64 {
+		v = (math.Log2(math.Max(v, 1e-10)) - minEV) / (maxEV - minEV)
+		v = math.Max(0, math.Min(1, v))
+		// polynomial fit of the sigmoid
+		v2 := v * v
+		v4 := v2 * v2
+		return 15.5*v4*v2 - 40.14*v4*v + 31.96*v4 - 6.868*v2*v + 0.4298*v2 + 0.1191*v - 0.00232
+	}
+	c = mulMatrix(agxOutset, Color{curve(c.r), curve(c.g), curve(c.b)})
+	// the sigmoid produces display encoded values, which are linearized again
+	c = Color{math.Pow(math.Max(0, c.r), 2.2), math.Pow(math.Max(0, c.g), 2.2), math.Pow(math.Max(0, c.b), 2.2)}
+	return mulMatrix(rec2020ToSRGB, c)
+}
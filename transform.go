@@ -0,0 +1,258 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// TransformKey is a transformation of an object at a point in time,
+// points are scaled, then rotated around x, y and z axes and then translated
+type TransformKey struct {
+	time          float64
+	translation   Tuple
+	rotation      Tuple // angles in radians
+	scale         Tuple
+	interpolation int
+}
+
+// Instance is a group of objects in local space moved by keyframed transformations
+type Instance struct {
+	objects HittableList
+	keys    []TransformKey
+	bounds  AABB // bounds of the objects over the whole motion and animation
+}
+
+// InstanceBVH is a bounding volume hierarchy over the motion bounds of instances, only leaves have instances
+type InstanceBVH struct {
+	left, right *InstanceBVH
+	bounds      AABB
+	instances   []Instance
+}
+
+func lerpTuple(a, b Tuple, t float64) Tuple {
+	return a.MulScalar(1 - t).Add(b.MulScalar(t))
+}
+
+// transformAt interpolates keys, holding the first and the last key outside of their range
+func transformAt(keys []TransformKey, time float64) TransformKey {
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	indices, weights := keyWeights(len(keys), func(i int) (float64, int) {
+		return keys[i].time, keys[i].interpolation
+	}, time)
+	k := TransformKey{time, Tuple{0, 0, 0, 0}, Tuple{0, 0, 0, 0}, Tuple{0, 0, 0, 0}, LinearInterpolation}
+	for j, i := range indices {
+		k.translation = k.translation.Add(keys[i].translation.MulScalar(weights[j]))
+		k.rotation = k.rotation.Add(keys[i].rotation.MulScalar(weights[j]))
+		k.scale = k.scale.Add(keys[i].scale.MulScalar(weights[j]))
+	}
+	return k
+}
+
+func rotateX(v Tuple, angle float64) Tuple {
+	sin, cos := math.Sincos(angle)
+	return Tuple{v.x, v.y*cos - v.z*sin, v.y*sin + v.z*cos, v.w}
+}
+
+func rotateY(v Tuple, angle float64) Tuple {
+	sin, cos := math.Sincos(angle)
+	return Tuple{v.x*cos + v.z*sin, v.y, -v.x*sin + v.z*cos, v.w}
+}
+
+func rotateZ(v Tuple, angle float64) Tuple {
+	sin, cos := math.Sincos(angle)
+	return Tuple{v.x*cos - v.y*sin, v.x*sin + v.y*cos, v.z, v.w}
+}
+
+func (k TransformKey) rotate(v Tuple) Tuple {
+	return rotateZ(rotateY(rotateX(v, k.rotation.x), k.rotation.y), k.rotation.z)
+}
+
+func (k TransformKey) inverseRotate(v Tuple) Tuple {
+	return rotateX(rotateY(rotateZ(v, -k.rotation.z), -k.rotation.y), -k.rotation.x)
+}
+
+// vector transforms direction from local to world space
+func (k TransformKey) vector(v Tuple) Tuple {
+	return k.rotate(Tuple{v.x * k.scale.x, v.y * k.scale.y, v.z * k.scale.z, v.w})
+}
+
+// point transforms point from local to world space
+func (k TransformKey) point(p Tuple) Tuple {
+	return k.vector(p).Add(k.translation)
+}
+
+// inverseVector transforms direction from world to local space
+func (k TransformKey) inverseVector(v Tuple) Tuple {
+	v = k.inverseRotate(v)
+	return Tuple{v.x / k.scale.x, v.y / k.scale.y, v.z / k.scale.z, v.w}
+}
+
+// inversePoint transforms point from world to local space
+func (k TransformKey) inversePoint(p Tuple) Tuple {
+	return k.inverseVector(p.Subtract(k.translation))
+}
+
+// normal transforms normal from local to world space using inverse transpose of the transformation
+func (k TransformKey) normal(n Tuple) Tuple {
+	return k.rotate(Tuple{n.x / k.scale.x, n.y / k.scale.y, n.z / k.scale.z, n.w}).Normalize()
+}
+
+// triangleArea returns area of the triangle transformed from local to world space
+func (k TransformKey) triangleArea(t Triangle) float64 {
+	t.position = TrianglePosition{k.point(t.position.vertex0), k.point(t.position.vertex1), k.point(t.position.vertex2)}
+	return t.area()
+}
+
+// sphereArea returns area of the sphere transformed from local to world space, an unevenly scaled sphere
+// is an ellipsoid, whose area is approximated by the formula of Knud Thomsen
+func (k TransformKey) sphereArea(s Sphere) float64 {
+	const p = 1.6075
+	a, b, c := math.Pow(s.radius*math.Abs(k.scale.x), p), math.Pow(s.radius*math.Abs(k.scale.y), p), math.Pow(s.radius*math.Abs(k.scale.z), p)
+	return 4 * math.Pi * math.Pow((a*b+a*c+b*c)/3, 1/p)
+}
+
+func (box AABB) union(other AABB) AABB {
+	return AABB{
+		Tuple{math.Min(box.min.x, other.min.x), math.Min(box.min.y, other.min.y), math.Min(box.min.z, other.min.z), 0},
+		Tuple{math.Max(box.max.x, other.max.x), math.Max(box.max.y, other.max.y), math.Max(box.max.z, other.max.z), 0},
+	}
+}
+
+// motionSteps is the number of samples between keys used to bound rotating objects
+const motionSteps = 16
+
+// getInstance builds instance from objects in local space
+func getInstance(spheres []Sphere, triangles []Triangle, keys []TransformKey) Instance {
+	objects := HittableList{spheres, BVH{}, nil}
+	local := AABB{
+		Tuple{math.MaxFloat64, math.MaxFloat64, math.MaxFloat64, 0},
+		Tuple{-math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64, 0},
+	}
+	for _, s := range spheres {
+		local = local.union(AABB{s.origin.AddScalar(-s.radius), s.origin.AddScalar(s.radius)})
+	}
+	if len(triangles) > 0 {
+		local = local.union(getBoundingBox(triangles))
+		objects.bvh = *getBVH(triangles, 10, 0)
+	}
+
+	bounds := AABB{
+		Tuple{math.MaxFloat64, math.MaxFloat64, math.MaxFloat64, 0},
+		Tuple{-math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64, 0},
+	}
+	// bound corners of the local box at keys and in between them
+	times := []float64{keys[0].time}
+	for i := 1; i < len(keys); i++ {
+		for s := 1; s <= motionSteps; s++ {
+			times = append(times, keys[i-1].time+(keys[i].time-keys[i-1].time)*float64(s)/motionSteps)
+		}
+	}
+	corners := func(time float64) [8]Tuple {
+		k := transformAt(keys, time)
+		var points [8]Tuple
+		for c := range points {
+			corner := local.min
+			if c&1 != 0 {
+				corner.x = local.max.x
+			}
+			if c&2 != 0 {
+				corner.y = local.max.y
+			}
+			if c&4 != 0 {
+				corner.z = local.max.z
+			}
+			points[c] = k.point(corner)
+		}
+		return points
+	}
+	previous := corners(times[0])
+	for _, p := range previous {
+		bounds = bounds.union(AABB{p, p})
+	}
+	for _, time := range times[1:] {
+		current := corners(time)
+		// points on an arc between two samples stay closer to one of its ends than the length of the chord,
+		// so padding by the longest step of a corner covers rotation between the samples
+		step := 0.0
+		for c := range current {
+			step = math.Max(step, current[c].Subtract(previous[c]).Magnitude())
+		}
+		for c := range current {
+			bounds = bounds.union(AABB{previous[c].AddScalar(-step), previous[c].AddScalar(step)})
+			bounds = bounds.union(AABB{current[c].AddScalar(-step), current[c].AddScalar(step)})
+		}
+		previous = current
+	}
+	// padding keeps flat objects from having empty bounds
+	bounds.min = bounds.min.AddScalar(-Epsilon)
+	bounds.max = bounds.max.AddScalar(Epsilon)
+	return Instance{objects, keys, bounds}
+}
+
+func (in *Instance) hit(r Ray, tMin, tMax float64, rec *HitRecord) bool {
+	if !in.bounds.hit(r, tMin, tMax) {
+		return false
+	}
+	k := transformAt(in.keys, r.time)
+	// the transformation is affine, so distances along the ray stay the same
+	local := Ray{k.inversePoint(r.origin), k.inverseVector(r.direction), r.width, r.spread, r.time}
+	if !in.objects.hit(local, tMin, tMax, rec) {
+		return false
+	}
+	rec.p = r.Position(rec.t)
+	rec.normal = k.normal(rec.normal)
+	rec.tangent = k.vector(rec.tangent)
+	return true
+}
+
+// getInstanceBVH splits instances at the median of the centers of their bounds along the longest axis, nil when there are none
+func getInstanceBVH(instances []Instance) *InstanceBVH {
+	if len(instances) == 0 {
+		return nil
+	}
+	bounds := instances[0].bounds
+	for _, in := range instances[1:] {
+		bounds = bounds.union(in.bounds)
+	}
+	if len(instances) <= 2 {
+		return &InstanceBVH{nil, nil, bounds, instances}
+	}
+	size := bounds.max.Subtract(bounds.min)
+	center := func(box AABB) float64 {
+		c := box.min.Add(box.max)
+		if size.x >= size.y && size.x >= size.z {
+			return c.x
+		} else if size.y >= size.z {
+			return c.y
+		}
+		return c.z
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return center(instances[i].bounds) < center(instances[j].bounds)
+	})
+	half := len(instances) / 2
+	return &InstanceBVH{getInstanceBVH(instances[:half]), getInstanceBVH(instances[half:]), bounds, nil}
+}
+
+func (tree *InstanceBVH) hit(r Ray, tMin, tMax float64, rec *HitRecord) bool {
+	if tree == nil || !tree.bounds.hit(r, tMin, tMax) {
+		return false
+	}
+	hitAnything := false
+	for i := range tree.instances {
+		if tree.instances[i].hit(r, tMin, tMax, rec) {
+			hitAnything = true
+			tMax = rec.t
+		}
+	}
+	if tree.left.hit(r, tMin, tMax, rec) {
+		hitAnything = true
+		tMax = rec.t
+	}
+	if tree.right.hit(r, tMin, tMax, rec) {
+		hitAnything = true
+	}
+	return hitAnything
+}
@@ -1,13 +1,46 @@
 package main
 
+import "math"
+
 type TrianglePosition struct {
 	vertex0, vertex1, vertex2 Tuple
 }
 
 type Triangle struct {
-	position TrianglePosition
-	vnormals TrianglePosition
-	material Material
-	normal   Tuple
-	smooth   bool
+	position   TrianglePosition
+	vnormals   TrianglePosition
+	material   Material
+	normal     Tuple
+	smooth     bool
+	uvs        TrianglePosition // texture coordinates stored in x and y
+	tangents   TrianglePosition // direction of increasing u at each vertex
+	handedness float64          // sign of the bitangent relative to normal x tangent
+	hasUV      bool
+}
+
+// area returns surface area of the triangle
+func (tri Triangle) area() float64 {
+	edge1 := tri.position.vertex1.Subtract(tri.position.vertex0)
+	edge2 := tri.position.vertex2.Subtract(tri.position.vertex0)
+	return edge1.Cross(edge2).Magnitude() / 2
+}
+
+// uvTangent returns direction of increasing u on the triangle and handedness of the tangent frame
+func uvTangent(position, uvs TrianglePosition) (Tuple, float64) {
+	edge1 := position.vertex1.Subtract(position.vertex0)
+	edge2 := position.vertex2.Subtract(position.vertex0)
+	du1, dv1 := uvs.vertex1.x-uvs.vertex0.x, uvs.vertex1.y-uvs.vertex0.y
+	du2, dv2 := uvs.vertex2.x-uvs.vertex0.x, uvs.vertex2.y-uvs.vertex0.y
+	det := du1*dv2 - du2*dv1
+	if math.Abs(det) < Epsilon {
+		return Tuple{0, 0, 0, 0}, 1
+	}
+	tangent := edge1.MulScalar(dv2).Subtract(edge2.MulScalar(dv1)).DivScalar(det)
+	bitangent := edge2.MulScalar(du1).Subtract(edge1.MulScalar(du2)).DivScalar(det)
+	// the bitangent of the frame points up the image, against increasing v
+	normal := edge1.Cross(edge2)
+	if normal.Cross(tangent).Dot(bitangent) > 0 {
+		return tangent, -1
+	}
+	return tangent, 1
 }